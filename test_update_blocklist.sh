@@ -0,0 +1,441 @@
+#!/bin/sh -e
+#
+# Tests for update_blocklist.sh. Unbound's commands are replaced by fakes and
+# only local lists are used, so neither Unbound nor network access is needed.
+# Prints the failed tests and exits with 1 if there were any.
+
+script=$(readlink -f "$(dirname "$0")/update_blocklist.sh")
+dir=$(mktemp -d --tmpdir test_update_blocklist.XXXXXX)
+trap "rm -r '$dir'" EXIT
+failures=0
+
+mkdir "${dir}/bin"
+printf '#!/bin/sh\nexit 0\n' >"${dir}/bin/unbound-control"
+printf '#!/bin/sh\nexit 0\n' >"${dir}/bin/unbound-checkconf"
+chmod 755 "${dir}"/bin/*
+
+# Run the script with the arguments in $@ and without default sources, writing
+# its files to $dir. The public suffix list and Unbound's main config are only
+# used if BLOCKLIST_PSL_URL and BLOCKLIST_MAIN_CONFIG are set.
+run() {
+  PATH="${dir}/bin:${PATH}" \
+    BLOCKLIST_CONFIG="${dir}/blocklist.conf" \
+    BLOCKLIST_CHUNK_DIR="${dir}/blocklist.d" \
+    BLOCKLIST_RPZ_ZONEFILE="${dir}/blocklist.rpz" \
+    BLOCKLIST_STATE_DIR="${dir}/state" \
+    BLOCKLIST_MAIN_CONFIG="${BLOCKLIST_MAIN_CONFIG-}" \
+    BLOCKLIST_PSL_URL="${BLOCKLIST_PSL_URL-}" \
+    BLOCKLIST_HEALTH_SERVER= \
+    BLOCKLIST_HEALTH_TIMEOUT=0 \
+    sh -e "$script" --no-default-sources "$@"
+}
+
+# Record a failure of the test named $1.
+fail() {
+  echo "FAIL: $1" >&2
+  failures=$((failures + 1))
+}
+
+# A failed reload restores the previous config.
+echo old.example >"${dir}/old"
+echo new.example >"${dir}/new"
+run --deny-url "${dir}/old format=domains" --reload-cmd true
+if BLOCKLIST_PUBLISH_DIR="${dir}/pub" \
+    run --deny-url "${dir}/new format=domains" --reload-cmd false \
+    -o unbound= -o "domains=${dir}/domains.txt" 2>/dev/null; then
+  fail "reload failure: run succeeded"
+fi
+[ ! -e "${dir}/domains.txt" ] || fail "reload failure: other output written"
+[ -z "$(ls "${dir}/pub" 2>/dev/null)" ] ||
+  fail "reload failure: outputs published"
+grep -q '"old.example"' "${dir}/blocklist.conf" ||
+  fail "reload failure: previous config not restored"
+[ ! -e "${dir}/blocklist.conf.bak" ] ||
+  fail "reload failure: backup left behind"
+if run --deny-url "${dir}/new format=domains" --reload-cmd false \
+    --feed "${dir}/feed.xml" 2>/dev/null; then
+  fail "reload failure: feed run succeeded"
+fi
+[ ! -e "${dir}/feed.xml" ] || fail "reload failure: feed written"
+[ ! -e "${dir}/state/feed-entries" ] || fail "reload failure: feed entry saved"
+run --deny-url "${dir}/new format=domains" --reload-cmd true \
+  --feed "${dir}/feed.xml"
+grep -q '^+ new.example$' "${dir}/feed.xml" ||
+  fail "reload failure: feed missing change after successful run"
+
+# Blocking the parent of a safe zone still blocks the parent and overrides the
+# safe zone, also with RPZ.
+printf 'google.com\nclients3.google.com\n' >"${dir}/google"
+run --deny-url "${dir}/google format=domains" --block-tld org \
+  --reload-cmd true
+grep -q '^local-zone: "google.com" ' "${dir}/blocklist.conf" ||
+  fail "safe zones: parent not blocked"
+grep -q '^local-zone: "clients3.google.com" transparent$' \
+  "${dir}/blocklist.conf" || fail "safe zones: safe zone not overridden"
+grep -q '^local-zone: "pool.ntp.org" transparent$' "${dir}/blocklist.conf" ||
+  fail "safe zones: safe zone in blocked TLD not overridden"
+run --deny-url "${dir}/google format=domains" --format rpz --reload-cmd true
+grep -q '^clients3.google.com CNAME rpz-passthru.$' "${dir}/blocklist.rpz" ||
+  fail "safe zones: no RPZ passthru"
+
+# Domains containing safe zones aren't rolled up.
+echo com >"${dir}/psl"
+printf 'a.microsoft.com\nb.microsoft.com\nc.microsoft.com\n' >"${dir}/ms"
+BLOCKLIST_PSL_URL="${dir}/psl" run --deny-url "${dir}/ms format=domains" \
+  --rollup 2 --reload-cmd true
+! grep -q '"microsoft.com"' "${dir}/blocklist.conf" ||
+  fail "rollup: domain containing safe zone rolled up"
+BLOCKLIST_PSL_URL="${dir}/psl" BLOCKLIST_SAFE_ZONES= \
+  run --deny-url "${dir}/ms format=domains" --rollup 2 --reload-cmd true
+grep -q '"microsoft.com"' "${dir}/blocklist.conf" ||
+  fail "rollup: not rolled up"
+
+# The main config is checked with the new files before they're installed.
+cat >"${dir}/bin/checkconf-main" <<'EOF'
+#!/bin/sh
+sed -n -e 's/^include: "\(.*\)"$/\1/p' "$1" | while read -r f; do
+  ! grep -q bad.example "$f" || exit 1
+done
+EOF
+chmod 755 "${dir}/bin/checkconf-main"
+mkdir "${dir}/main.d"
+echo 'include: "'"${dir}"'/main.d/*.conf"' >"${dir}/main.conf"
+echo bad.example >"${dir}/bad"
+echo 'server:' >"${dir}/main.d/other.conf"
+export BLOCKLIST_MAIN_CONFIG="${dir}/main.conf"
+run --deny-url "${dir}/old format=domains" --reload-cmd true \
+  --unbound-config "${dir}/main.d/blocklist.conf" --checkconf-cmd checkconf-main
+if run --deny-url "${dir}/bad format=domains" --reload-cmd true \
+    --unbound-config "${dir}/main.d/blocklist.conf" \
+    --checkconf-cmd checkconf-main 2>/dev/null; then
+  fail "main config: run succeeded"
+fi
+grep -q '"old.example"' "${dir}/main.d/blocklist.conf" ||
+  fail "main config: installed config replaced"
+[ "$(ls "${dir}/main.d")" = "blocklist.conf
+other.conf" ] || fail "main config: staged files left behind"
+[ ! -e "${dir}/main.conf.check" ] || fail "main config: check copy left behind"
+unset BLOCKLIST_MAIN_CONFIG
+
+# With a chroot, Unbound output paths and the main config are within it.
+mkdir -p "${dir}/root/etc/unbound/conf.d"
+echo 'include: "/etc/unbound/conf.d/*.conf"' \
+  >"${dir}/root/etc/unbound/main.conf"
+if BLOCKLIST_MAIN_CONFIG=/etc/unbound/main.conf \
+    run --deny-url "${dir}/bad format=domains" --reload-cmd true \
+    --chroot "${dir}/root" -o unbound=/etc/unbound/conf.d/blocklist.conf \
+    --checkconf-cmd checkconf-main 2>/dev/null; then
+  fail "chroot: main config not checked"
+fi
+BLOCKLIST_MAIN_CONFIG=/etc/unbound/main.conf \
+  run --deny-url "${dir}/old format=domains" --reload-cmd true \
+  --chroot "${dir}/root" -o unbound=/etc/unbound/conf.d/blocklist.conf \
+  --checkconf-cmd checkconf-main
+grep -q '"old.example"' "${dir}/root/etc/unbound/conf.d/blocklist.conf" ||
+  fail "chroot: config not written within chroot"
+
+# dnsmasq "server" directives only block domains without a server, and ones
+# with "#" are exemptions.
+cat >"${dir}/dnsmasq" <<'EOF'
+address=/tracker.example/0.0.0.0
+local=/local.example/
+server=/ok.tracker.example/#
+server=/fwd.example/0.0.0.0
+server=/fwd2.example/192.0.2.1
+EOF
+run --deny-url "${dir}/dnsmasq format=dnsmasq" --reload-cmd true
+grep -q '^local-zone: "tracker.example" ' "${dir}/blocklist.conf" ||
+  fail "dnsmasq: address not blocked"
+grep -q '^local-zone: "local.example" ' "${dir}/blocklist.conf" ||
+  fail "dnsmasq: local not blocked"
+grep -q '^local-zone: "ok.tracker.example" transparent$' \
+  "${dir}/blocklist.conf" || fail "dnsmasq: exemption not allowed"
+! grep -q 'fwd' "${dir}/blocklist.conf" ||
+  fail "dnsmasq: forwarded domain blocked"
+
+# Only the CNAME targets of allowed domains are allowed, not their parents.
+cat >"${dir}/bin/dig" <<'EOF'
+#!/bin/sh
+for a; do
+  [ "$a" = site.example ] && printf 'cdn.tracker.example.\n192.0.2.1\n'
+done
+EOF
+chmod 755 "${dir}/bin/dig"
+echo '^site\.example$' >"${dir}/allow"
+printf 'tracker.example\nsite.example\n' >"${dir}/cloaked"
+run --deny-url "${dir}/cloaked format=domains" --allow-file "${dir}/allow" \
+  --uncloak --reload-cmd true
+grep -q '^local-zone: "tracker.example" ' "${dir}/blocklist.conf" ||
+  fail "uncloak: parent of CNAME target not blocked"
+grep -q '^local-zone: "cdn.tracker.example" transparent$' \
+  "${dir}/blocklist.conf" || fail "uncloak: CNAME target not allowed"
+rm "${dir}/bin/dig"
+
+# Template output without a template file is a usage error.
+st=0
+run --deny-url "${dir}/old format=domains" -o "template=${dir}/out.txt" \
+  2>/dev/null || st=$?
+[ "$st" -eq 2 ] || fail "template: got status ${st} without template file"
+[ ! -e "${dir}/out.txt" ] || fail "template: output written"
+
+# Inactive category schedules leave their zones out of the config, and the
+# schedule command adds them once the schedule starts.
+days="sun mon tue wed thu fri sat"
+off="$(echo $days | cut -d' ' -f$((($(date +%w) + 2) % 7 + 1)))@00:00-00:01"
+cat >"${dir}/bin/unbound-control" <<EOF
+#!/bin/sh
+case "\$1" in
+  local_zones*) echo "\$1" >>"${dir}/control.log"; cat >>"${dir}/control.log" ;;
+esac
+exit 0
+EOF
+echo chat.example >"${dir}/social"
+echo ads.example >"${dir}/ads"
+run --deny-url "${dir}/social format=domains categories=social" \
+  --deny-url "${dir}/ads format=domains" --reload-cmd true \
+  --category-schedule "social=${off}"
+grep -q '"ads.example"' "${dir}/blocklist.conf" ||
+  fail "category schedule: unscheduled zone not blocked"
+! grep -q '"chat.example"' "${dir}/blocklist.conf" ||
+  fail "category schedule: inactive zone blocked"
+sed -i -e 's/ [^ ]* zones$/ 00:00-00:00 zones/' "${dir}/state/schedules"
+: >"${dir}/control.log"
+run schedule
+[ "$(cat "${dir}/control.log")" = "local_zones
+chat.example refuse" ] || fail "category schedule: zone not added"
+
+# Scheduled sources with clients= keep their zones and tags in the config
+# while they're inactive, and the schedule command blocks them again.
+printf 'game.example\nsub.ads.example\n' >"${dir}/games"
+export BLOCKLIST_CLIENT_TAGS="kids=192.0.2.0/24"
+run --deny-url "${dir}/ads format=domains" \
+  --deny-url "${dir}/games format=domains clients=kids schedule=${off}" \
+  --reload-cmd true
+grep -q '^local-zone: "game.example" transparent$' "${dir}/blocklist.conf" ||
+  fail "tag schedule: inactive zone not transparent"
+grep -q '^local-zone-tag: "game.example" "kids"$' "${dir}/blocklist.conf" ||
+  fail "tag schedule: zone not tagged"
+grep -q '^access-control-tag: 192.0.2.0/24 "kids"$' "${dir}/blocklist.conf" ||
+  fail "client tags: netblock not tagged"
+! grep -q '^access-control: ' "${dir}/blocklist.conf" ||
+  fail "client tags: access control changed"
+! grep -q '"sub.ads.example"' "${dir}/blocklist.conf" ||
+  fail "tag schedule: zone within always blocked zone kept"
+sed -i -e 's/ [^ ]* tags$/ 00:00-00:00 tags/' "${dir}/state/schedules"
+: >"${dir}/control.log"
+run schedule
+[ "$(cat "${dir}/control.log")" = "local_zones
+game.example refuse" ] || fail "tag schedule: zone not blocked"
+unset BLOCKLIST_CLIENT_TAGS
+printf '#!/bin/sh\nexit 0\n' >"${dir}/bin/unbound-control"
+
+# Comments in domain lists don't need to be preceded by whitespace.
+printf 'nospace.example#comment\nspace.example # category:ads\n' \
+  >"${dir}/comments"
+run --deny-url "${dir}/comments format=domains" --reload-cmd true
+grep -q '"nospace.example"' "${dir}/blocklist.conf" ||
+  fail "domains: entry followed by comment dropped"
+grep -q '"space.example"' "${dir}/blocklist.conf" ||
+  fail "domains: entry followed by category annotation dropped"
+
+# Internationalized names are converted by one idn2 process and never passed
+# through the shell. Like idn2, the fake exits at names it can't convert.
+cat >"${dir}/bin/idn2" <<'EOF'
+#!/bin/sh
+echo run >>"$IDN2_LOG"
+while read -r name; do
+  case "$name" in bad*) exit 1 ;; esac
+  echo "xn--x.${name#*.}"
+done
+EOF
+chmod 755 "${dir}/bin/idn2"
+printf '%s\n' "$(printf '\303\274')';touch\${IFS}${dir}/pwned;'" \
+  "bad$(printf '\303\274').example" "$(printf '\303\274').allowed.example" \
+  >"${dir}/idn-allow"
+echo allowed.example >"${dir}/idn-deny"
+IDN2_LOG="${dir}/idn2.log" run --deny-url "${dir}/idn-deny format=domains" \
+  --allow-url "${dir}/idn-allow format=domains" --reload-cmd true 2>/dev/null
+[ ! -e "${dir}/pwned" ] || fail "idn: allow list entry ran a command"
+[ "$(cat "${dir}/idn2.log")" = "run
+run" ] || fail "idn: idn2 not run once per rejected name"
+grep -q '"xn--x.allowed.example" transparent' "${dir}/blocklist.conf" ||
+  fail "idn: name after rejected one not converted"
+rm "${dir}/bin/idn2"
+
+# Sources that can't be decompressed fail instead of being truncated.
+seq 5000 | sed -e 's/$/.gz.example/' | gzip | head -c 2000 >"${dir}/trunc.gz"
+if run --deny-url "${dir}/trunc.gz format=domains" --reload-cmd true \
+    2>/dev/null; then
+  fail "decompress: truncated source accepted"
+fi
+! grep -q '"1.gz.example"' "${dir}/blocklist.conf" ||
+  fail "decompress: truncated source installed"
+
+# Failed zone transfers fail the source.
+printf '#!/bin/sh\nexit 9\n' >"${dir}/bin/dig"
+chmod 755 "${dir}/bin/dig"
+if run --deny-url "axfr://127.0.0.1/rpz.example" --reload-cmd true \
+    2>/dev/null; then
+  fail "axfr: failed transfer accepted"
+fi
+rm "${dir}/bin/dig"
+
+# Gravity databases that can't be read fail the source.
+printf 'SQLite format 3\000' >"${dir}/gravity.db"
+printf '#!/bin/sh\nexit 127\n' >"${dir}/bin/sqlite3"
+chmod 755 "${dir}/bin/sqlite3"
+if run --deny-url "${dir}/gravity.db" --reload-cmd true 2>/dev/null; then
+  fail "gravity: unreadable database accepted"
+fi
+run --deny-url "${dir}/gravity.db required=no" --reload-cmd true \
+  2>/dev/null || fail "gravity: optional unreadable database not skipped"
+rm "${dir}/bin/sqlite3"
+
+# JSON feeds that jq can't parse fail the source.
+printf '[{"domain": "json.example"}, {"domain": "tru' >"${dir}/trunc.json"
+if run --deny-url "${dir}/trunc.json format=json" --reload-cmd true \
+    2>/dev/null; then
+  fail "json: truncated feed accepted"
+fi
+
+# MISP feeds fail if an event can't be fetched or parsed.
+mkdir "${dir}/misp"
+echo '{"e1": {}, "e2": {}}' >"${dir}/misp/manifest.json"
+echo '{"Event": {"Attribute": [{"type": "domain", "value": "misp.example"}]}}' \
+  >"${dir}/misp/e1.json"
+if run --deny-url "${dir}/misp/manifest.json format=misp" --reload-cmd true \
+    2>/dev/null; then
+  fail "misp: missing event accepted"
+fi
+echo '{"Event": {"Attribute": [' >"${dir}/misp/e2.json"
+if run --deny-url "${dir}/misp/manifest.json format=misp" --reload-cmd true \
+    2>/dev/null; then
+  fail "misp: invalid event accepted"
+fi
+echo '{"Event": {}}' >"${dir}/misp/e2.json"
+run --deny-url "${dir}/misp/manifest.json format=misp" --reload-cmd true
+grep -q '"misp.example"' "${dir}/blocklist.conf" || fail "misp: zone missing"
+
+# Only the url field of URLhaus CSV dumps is blocked.
+printf '%s%s\n' '"1","2024-01-01","http://urlhaus.example/x","online","",' \
+  '"malware_download","elf","https://urlhaus.abuse.ch/url/1/","a"' \
+  >"${dir}/urlhaus.csv"
+run --deny-url "${dir}/urlhaus.csv format=urlhaus" --reload-cmd true
+grep -q '"urlhaus.example"' "${dir}/blocklist.conf" ||
+  fail "urlhaus: url field not blocked"
+! grep -q '"urlhaus.abuse.ch"' "${dir}/blocklist.conf" ||
+  fail "urlhaus: urlhaus_link blocked"
+
+# Audited zones don't unblock names within zones blocked by other sources.
+echo parent.example >"${dir}/enforced"
+printf 'ads.parent.example\naudited.example\n' >"${dir}/audited"
+run --deny-url "${dir}/enforced format=domains" \
+  --deny-url "${dir}/audited format=domains action=audit" --reload-cmd true
+! grep -q 'ads\.parent\.example' "${dir}/blocklist.conf" ||
+  fail "audit: zone within blocked zone kept"
+grep -q '"audited.example" inform' "${dir}/blocklist.conf" ||
+  fail "audit: other zone dropped"
+run --deny-url "${dir}/enforced format=domains" \
+  --deny-url "${dir}/audited format=domains action=audit" --format rpz \
+  --reload-cmd true
+! grep -q 'ads\.parent\.example' "${dir}/blocklist.rpz" ||
+  fail "audit: RPZ zone within blocked zone kept"
+# SafeSearch targets within redirect zones aren't redirected to themselves.
+printf 'safe.duckduckgo.com\nother.example\n' >"${dir}/ddg"
+run --deny-url "${dir}/ddg format=domains" --safesearch --reload-cmd true
+[ "$(grep -c '"safe\.duckduckgo\.com"' "${dir}/blocklist.conf")" -eq 1 ] &&
+  grep -q '"safe.duckduckgo.com" transparent' "${dir}/blocklist.conf" ||
+  fail "safesearch: target within redirect zone not passed through"
+
+# HTML pages served as lists don't replace the cached copy. The fake wget
+# serves the file named by $WGET_BODY as text/plain.
+cat >"${dir}/bin/wget" <<'EOF'
+#!/bin/sh
+for a; do
+  case "$a" in --output-file=*) log=${a#*=} ;; esac
+  [ "$prev" = -O ] && out=$a
+  prev=$a
+done
+printf '  HTTP/1.1 200 OK\n  Content-Type: text/plain\n' >"$log"
+cp "$WGET_BODY" "$out"
+EOF
+chmod 755 "${dir}/bin/wget"
+echo cached.example >"${dir}/list"
+printf '<!DOCTYPE html>\n<html><body>Log in</body></html>\n' >"${dir}/portal"
+WGET_BODY="${dir}/list" run --deny-url "http://lists.example/list" \
+  --reload-cmd true
+WGET_BODY="${dir}/portal" run --deny-url "http://lists.example/list" \
+  --reload-cmd true 2>/dev/null || fail "html: cached copy not used"
+grep -q '"cached.example"' "${dir}/blocklist.conf" ||
+  fail "html: cached zone missing"
+rm "${dir}/bin/wget"
+
+# Rules limited to third-party or first-party requests don't block the domain.
+printf '%s\n' '||tp.example^$third-party' '||fp.example^$~third-party' \
+  '||full.example^$important' >"${dir}/abp"
+run --deny-url "${dir}/abp format=abp" --reload-cmd true
+! grep -q 'tp\.example\|fp\.example' "${dir}/blocklist.conf" ||
+  fail "abp: party-restricted rule blocked"
+grep -q '"full.example"' "${dir}/blocklist.conf" || fail "abp: rule missing"
+
+# EDL and Squid output can't express exceptions, so parents of safe zones are
+# only blocked themselves.
+printf 'google.com\nexample.net\n' >"${dir}/google-sub"
+run --deny-url "${dir}/google-sub format=domains" --reload-cmd true \
+  -o "edl=${dir}/blocklist.edl" -o "squid=${dir}/blocklist.squid"
+! grep -q '^\*\.google\.com$' "${dir}/blocklist.edl" ||
+  fail "edl: wildcard blocks safe zone"
+grep -q '^\*\.example\.net$' "${dir}/blocklist.edl" || fail "edl: no wildcard"
+grep -q '^google\.com$' "${dir}/blocklist.squid" &&
+  ! grep -q '^\.google\.com$' "${dir}/blocklist.squid" ||
+  fail "squid: subdomain entry blocks safe zone"
+
+# Files in directory sources and archives are kept on separate lines even if
+# they don't end with newlines.
+mkdir "${dir}/dir"
+printf 'a.example' >"${dir}/dir/a"
+printf 'b.example' >"${dir}/dir/b"
+run --deny-url "${dir}/dir format=domains" --reload-cmd true
+grep -q '"a.example"' "${dir}/blocklist.conf" &&
+  grep -q '"b.example"' "${dir}/blocklist.conf" ||
+  fail "dir: files merged"
+tar -cf "${dir}/dir.tar" -C "${dir}/dir" a b
+run --deny-url "${dir}/dir.tar format=domains" --reload-cmd true
+grep -q '"a.example"' "${dir}/blocklist.conf" &&
+  grep -q '"b.example"' "${dir}/blocklist.conf" ||
+  fail "archive: files merged"
+
+# Unbound sources can use every blocking type that the script writes.
+printf 'local-zone: "%s" %s\n' nodata.example always_nodata \
+  deny.example always_deny >"${dir}/unbound-types"
+run --deny-url "${dir}/unbound-types format=unbound" --reload-cmd true
+grep -q '"nodata.example"' "${dir}/blocklist.conf" &&
+  grep -q '"deny.example"' "${dir}/blocklist.conf" ||
+  fail "unbound: always_nodata or always_deny zone dropped"
+
+# A failed RPZ zone reload restores the previous zone file.
+echo old-rpz.example >"${dir}/rpz-list"
+run --deny-url "${dir}/rpz-list format=domains" --format rpz --reload-cmd true
+echo new-rpz.example >"${dir}/rpz-list"
+printf '#!/bin/sh\n[ "$1" != auth_zone_reload ]\n' >"${dir}/bin/unbound-control"
+if run --deny-url "${dir}/rpz-list format=domains" --format rpz \
+    --reload-cmd true 2>/dev/null; then
+  fail "rpz reload failure: succeeded"
+fi
+grep -q '^old-rpz\.example ' "${dir}/blocklist.rpz" ||
+  fail "rpz reload failure: previous zone not restored"
+printf '#!/bin/sh\nexit 0\n' >"${dir}/bin/unbound-control"
+
+# The timeout also limits retries. The fake wget always fails like a network
+# error, so only the first attempt and one retry fit in the 2 seconds.
+printf '#!/bin/sh\necho try >>"%s"\nexit 4\n' "${dir}/wget-tries" \
+  >"${dir}/bin/wget"
+chmod 755 "${dir}/bin/wget"
+BLOCKLIST_RETRY_DELAY=1 run --reload-cmd true \
+  --deny-url "http://lists.example/down timeout=2 retries=10 required=no" \
+  2>/dev/null
+[ "$(wc -l <"${dir}/wget-tries")" -eq 2 ] ||
+  fail "timeout: retried past the deadline"
+rm "${dir}/bin/wget"
+
+[ "$failures" -eq 0 ]
@@ -1,65 +1,4187 @@
 #!/bin/sh -e
 
-# URLs of hosts files listing zones to deny.
-# Entries should be mapped to "0.0.0.0".
+# The settings below can be overridden by a config file passed via -c/--config
+# (or named by $BLOCKLIST_CONFIG_FILE), which is sourced as a shell script and
+# can assign any of the uppercase variables (e.g. to replace DENY_URLS or set
+# FORMAT=rpz). Environment variables named by prefixing a setting with
+# "BLOCKLIST_" (e.g. BLOCKLIST_CONFIG or BLOCKLIST_RELOAD_CMD) take precedence
+# over the config file. The config file is deliberately a shell script rather
+# than YAML or TOML: no parser is needed, and settings can be copied from here
+# unchanged.
+
+# URLs of files listing zones to deny, one per line. Local paths, file:// URLs,
+# directories (whose files are concatenated), "-" (stdin),
+# "axfr://SERVER[:PORT]/ZONE" (an RPZ zone transfer), and
+# "git+REPO#PATH" (a file or directory in a git repository, which is cloned
+# into STATE_DIR and updated at most once per run) can also be used. Compressed
+# files and tar and zip archives are unpacked automatically, and
+# internationalized domain names are converted to punycode using idn2. Entries
+# in local files that are followed by comments like "# expires=2025-01-31" are
+# dropped after that date. Each URL can be followed by whitespace-separated
+# options:
+#
+#   format=FORMAT  "auto" (the default) to detect the format from the file's
+#                  contents, "hosts" for hosts files with entries mapped
+#                  to a sink address, "domains" for files listing one domain per
+#                  line, "dnsmasq" for dnsmasq "address=/domain/0.0.0.0"
+#                  directives, "rpz" for RPZ zone files, "abp" for Adblock
+#                  Plus "||domain^" rules, "gravity" for Pi-hole gravity.db
+#                  databases, "json" or "csv" for structured feeds, or
+#                  "unbound" for Unbound config files with local-zone
+#                  directives using blocking types, "urlhaus" or "threatfox"
+#                  for abuse.ch URLhaus and ThreatFox exports (whose
+#                  hostnames are categorized as "malware"), or "misp" for
+#                  MISP event JSON, feed manifest.json URLs, or MISP
+#                  instances' /attributes/restSearch URLs (RPZ
+#                  passthru records, ABP "@@" exceptions, dnsmasq
+#                  "server=/domain/#" exemptions, and Pi-hole allowlist
+#                  entries are added to the allow patterns)
+#   sink=IP[,IP]...
+#                  addresses that hosts file entries must be mapped to in
+#                  order to be blocked (default "0.0.0.0")
+#   categories=CATEGORY[,CATEGORY]...
+#                  categories for entries that don't specify their own (hosts
+#                  and domain entries can be followed by comments like
+#                  "# category:ads,tracking", and JSON and CSV records use
+#                  their category fields)
+#   origin=ZONE    RPZ zone name to strip from absolute owner names if the
+#                  file doesn't contain an $ORIGIN directive
+#   tsig-file=PATH BIND-format TSIG key file used to sign zone transfers
+#   ref=REF        git branch or tag to check out (default is the remote HEAD)
+#   domain-field=NAME
+#                  JSON or CSV field containing domains (default "domain");
+#                  dots separate the names of nested JSON fields
+#   category-field=NAME, category=VALUE[,VALUE]...
+#                  only use JSON or CSV records with one of the categories
+#   confidence-field=NAME, min-confidence=N
+#                  only use JSON or CSV records with at least this confidence
+#   tags=TAG[,TAG]...
+#                  only use MISP attributes with one of these tags (either on
+#                  the attribute or its event)
+#   misp-key-file=PATH
+#                  file containing the API key for MISP restSearch requests
+#   include=GLOB[,GLOB]..., exclude=GLOB[,GLOB]...
+#                  files to use from tar or zip archives, matched against
+#                  their paths within the archive (all files by default)
+#   action=TYPE    Unbound local-zone type used for the source's zones
+#                  (default ACTION); in RPZ output, it is mapped to the
+#                  closest policy action. "audit" logs queries for the zones
+#                  without blocking them (as Unbound's "inform" type), for
+#                  evaluating new sources; audited zones are omitted from
+#                  other formats and don't prevent other sources from
+#                  blocking them or their parents. "redirect" answers
+#                  queries with the sinkhole addresses
+#   clients=TAG[,TAG]...
+#                  only block the source's zones for clients with these
+#                  CLIENT_TAGS tags (Unbound output only)
+#   schedule=[DAYS@]HH:MM-HH:MM
+#                  only block the source's zones between these local times,
+#                  e.g. "sun-thu@21:00-07:00" for 9 PM to 7 AM on school
+#                  nights (Unbound output only; see the "schedule" command).
+#                  DAYS is a comma-separated list of days like "sat" and
+#                  ranges like "mon-fri" (every day by default), and times
+#                  that end before they start continue into the next day.
+#                  With clients=, the zones stay in the config and are made
+#                  "transparent" for the tagged clients while the schedule
+#                  is inactive, and zones within ones that other sources
+#                  always block for the same clients are dropped. Can't be
+#                  combined with the "redirect" action
+#   sinkhole=IP[,IP]...
+#                  addresses returned for the source's zones by the
+#                  "redirect" action (see SINKHOLE)
+#   required=yes|no
+#                  whether a failure to fetch the source aborts the run
+#                  (default "yes"); if "no", a warning is printed and the
+#                  source is treated as empty
+#   enabled=yes|no whether the source is used at all (default "yes")
+#   timeout=SECONDS
+#                  maximum time for fetching the source, including retries
+#                  (see FETCH_TIMEOUT)
+#   retries=N      number of times to retry failed downloads (see
+#                  FETCH_RETRIES)
+#   auth-file=PATH, auth-env=VAR
+#                  file or environment variable containing "USER:PASSWORD"
+#                  for HTTP basic authentication
+#   token-file=PATH, token-env=VAR
+#                  file or environment variable containing a bearer token
+#                  sent in an Authorization header
+#   header=NAME:VALUE
+#                  extra HTTP request header (may be repeated; the value
+#                  can't contain whitespace)
+#   user-agent=AGENT
+#                  User-Agent header overriding USER_AGENT for the source
+#   sha256=HEX, sha256-url=URL
+#                  expected SHA-256 checksum of the downloaded file (before
+#                  decompression), or the URL of a file containing it
+#   minisign-key=PATH, pgp-keyring=PATH, sig-url=URL
+#                  minisign public key file or PGP keyring used to verify the
+#                  downloaded file's detached signature, which is fetched from
+#                  sig-url= (by default, the source URL with ".minisig" or
+#                  ".sig" appended)
+#   ca-file=PATH   CA certificates used to verify the server instead of the
+#                  system's
+#   pin=sha256//BASE64[;sha256//BASE64]...
+#                  public key hashes that the server's key must match
+#   tls-min=1.2|1.3
+#                  minimum TLS version
+#   limit-rate=RATE
+#                  maximum download speed (see RATE_LIMIT)
+#   mirror=URL     URL to try if the previous ones fail (may be repeated)
+#   max-size=BYTES maximum size of the source (see MAX_SOURCE_SIZE)
+#   max-staleness=SECONDS
+#                  maximum age of a cached copy used when the source can't
+#                  be downloaded (see MAX_STALENESS)
+#   allow=URL      list of allow patterns (like ALLOW_URLS's regexp lists)
+#                  that only apply to the source (may be repeated)
+#   weight=N       score that the source contributes to each of its zones
+#                  (default 1; see MIN_SCORE)
+#   priority=N     how strongly to prefer the source's zones when MAX_ZONES is
+#                  reached (default 0; higher is preferred)
+#   candidates=yes|no
+#                  if "yes", only block the source's entries that match
+#                  DENY_PATTERN_URLS patterns or DENY_KEYWORDS (e.g. for lists
+#                  of all domains seen in query logs)
+#   public-suffixes=yes|no
+#                  whether the source may block public suffixes like "co.uk"
+#                  (default "no"; see PSL_URL)
 DENY_URLS="
   https://raw.githubusercontent.com/derat/dns-lists/master/deny-hosts
   https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts
 "
 
-# URL of file listing regular expressions matching always-permitted zones.
-ALLOW_URL=https://raw.githubusercontent.com/derat/dns-lists/master/allow-patterns
+# Newline-separated URLs or local paths of files listing regular expressions
+# matching always-permitted zones. The lists are concatenated. Like DENY_URLS,
+# each URL can be followed by required=no. Lists with format=domains instead
+# contain one domain per line, which is allowed exactly, or with a leading '.'
+# (e.g. ".example.com") to also allow its subdomains. These are much faster to
+# check than patterns. In either format, "*.example.com" allows the domain and
+# all of its subdomains, and entries followed by comments like
+# "# expires=2025-01-31" are ignored with a warning after that date.
+ALLOW_URLS="
+  https://raw.githubusercontent.com/derat/dns-lists/master/allow-patterns
+"
+
+# Newline-separated URLs or local paths of files listing regular expressions
+# matching zones to block, in the same format as ALLOW_URLS's regexp lists.
+# Since Unbound can't block patterns, they're matched against the entries of
+# sources with the candidates=yes option, and only the matching ones are
+# blocked.
+DENY_PATTERN_URLS=
+
+# Whitespace-separated keywords (e.g. "telemetry doubleclick") that are
+# matched as substrings of zones like DENY_PATTERN_URLS patterns.
+DENY_KEYWORDS=
 
 # Path where the Unbound config file will be written.
 CONFIG=/etc/unbound/unbound.conf.d/blocklist.conf
 
+# Path where the RPZ zone file will be written in "rpz" format, and the name of
+# the zone. Unbound's module-config must include "respip" to use RPZ.
+RPZ_ZONEFILE=/etc/unbound/blocklist.rpz
+RPZ_NAME=blocklist.rpz
+
+# Directory where the Unbound config is split into multiple files when
+# --chunk-size or --split-sources is passed. It's a symlink that is replaced
+# atomically, and CONFIG just includes the files within it.
+CHUNK_DIR=/etc/unbound/blocklist.d
+
+# Owner (as USER[:GROUP], or empty to leave it unchanged) and mode of the
+# installed Unbound config, chunk, and RPZ zone files. If SELinux is enabled,
+# restorecon is also run on them after they're installed.
+FILE_OWNER=
+FILE_MODE=644
+
+# Directory that Unbound chroots to, if any. CONFIG (including paths passed
+# via -o for Unbound output), CHUNK_DIR, RPZ_ZONEFILE, and MAIN_CONFIG are then
+# paths within it, and the files are written below it and referred to by their
+# full paths, which Unbound accepts both before and after chrooting.
+UNBOUND_CHROOT=
+
+# Directory where state from the last successful run is kept. Downloaded lists
+# are cached in its "cache" subdirectory and revalidated using their ETag and
+# Last-Modified headers. If a list can't be downloaded, its cached copy is used
+# instead if it was last updated no more than MAX_STALENESS seconds ago.
+STATE_DIR=/var/lib/update_blocklist
+MAX_STALENESS=604800
+
+# Directory (e.g. one served over HTTP) where copies of the outputs are
+# published for other resolvers and blockers, along with gzip- and
+# zstd-compressed copies (the latter only if zstd is installed). Files are named
+# after their formats, e.g. "domains.txt" and "domains.txt.gz". Nothing is
+# published if the new Unbound config fails its checks or is rolled back. Empty
+# to disable.
+PUBLISH_DIR=
+
+# Commands used to validate the Unbound config and to make Unbound reload it.
+# The config's path is appended to CHECKCONF_CMD. If MAIN_CONFIG exists, a copy
+# of it that includes the new files instead of the installed ones is also
+# checked before anything is replaced, to catch conflicts with the rest of the
+# configuration. The default reload_unbound reloads via unbound-control
+# (keeping the cache if possible), falling back to SIGHUP and then to
+# restarting the service.
+CHECKCONF_CMD=unbound-checkconf
+MAIN_CONFIG=/etc/unbound/unbound.conf
+RELOAD_CMD=reload_unbound
+
+# Number of seconds to wait for Unbound to come back after reloading it. If it
+# doesn't, the previous config (kept with a ".bak" suffix) is restored and
+# Unbound is reloaded again.
+HEALTH_TIMEOUT=10
+
+# DNS server queried with dig once Unbound is back, to check that a zone from
+# the new config is blocked and that HEALTH_ALLOWED (if non-empty) is still
+# resolved. Wrong answers are also handled by restoring the previous config.
+# Empty to skip the queries.
+HEALTH_SERVER=127.0.0.1
+HEALTH_ALLOWED=
+
+# Maximum number of added, removed, and changed zones to apply to the running
+# Unbound with unbound-control instead of reloading it (0 to always reload).
+# This is only done for Unbound output when nothing but local-zone directives
+# changed.
+INCREMENTAL_MAX_CHANGES=0
+
+# Supported output formats.
+FORMATS="unbound rpz domains adblock dnsdist rbldnsd edl squid"
+
+# Default output format.
+FORMAT=unbound
+
+# If non-empty, each zone in Unbound and RPZ output is followed by a comment
+# listing the sources that contained it.
+ANNOTATE=
+
+# Unbound local-zone type used for zones from sources without action= options.
+# Some clients show errors for "refuse"; "always_nxdomain" or "always_null" may
+# work better for them.
+ACTION=refuse
+
+# Comma-separated IPv4 and IPv6 addresses returned for zones using the
+# "redirect" action, e.g. of a server showing a block page.
+SINKHOLE=
+
+# Whitespace-separated TAG=NETBLOCK[,NETBLOCK]... pairs (e.g.
+# "kids=10.0.1.0/24 guests=10.0.2.0/24,fd00:2::/64") assigning Unbound tags to
+# client address ranges. The Unbound config then defines the tags and assigns
+# them to the netblocks, and zones from sources with clients= options are only
+# blocked for clients with one of those tags. Queries from the netblocks still
+# need to be allowed with access-control in Unbound's own config.
+CLIENT_TAGS=
+
+# Unbound local-zone types that can be used as source actions.
+ACTIONS="refuse static deny redirect transparent"
+ACTIONS="${ACTIONS} always_refuse always_nxdomain always_nodata always_deny"
+ACTIONS="${ACTIONS} always_null inform inform_deny audit"
+
+# Maximum number of sources to fetch at once.
+FETCH_JOBS=4
+
+# Maximum number of seconds to randomly wait before fetching, and the number of
+# seconds to wait between starting downloads from the same host.
+JITTER=0
+STAGGER=0
+
+# Maximum size in bytes of each source after decompression (0 for no limit).
+# Larger sources are treated as failed.
+MAX_SOURCE_SIZE=268435456
+
+# DNS server address or DoH URL (e.g. "https://9.9.9.9/dns-query") used to
+# resolve the hosts of downloaded lists instead of the system resolver, which
+# may be broken or blocking them. If set, curl is used instead of wget. Hosts
+# reached via redirects are resolved by the system resolver when using a DNS
+# server.
+BOOTSTRAP_DNS=
+
+# Maximum speed of each download in bytes per second, with an optional "k" or
+# "m" suffix (e.g. "200k"), or empty for no limit. Note that FETCH_JOBS
+# downloads can run at once.
+RATE_LIMIT=
+
+# User-Agent header sent with HTTP requests. Some hosts block wget's default.
+USER_AGENT="update_blocklist (+https://github.com/derat/dns-lists)"
+
+# HTTP or SOCKS ("socks5h://HOST:PORT", which requires torsocks) proxy used for
+# downloads and git fetches. Zone transfers also use SOCKS proxies. If empty,
+# the http_proxy, https_proxy, and no_proxy environment variables (or their
+# uppercase equivalents) are used.
+PROXY=
+
+# SOCKS proxy used by --tor.
+TOR_PROXY=socks5h://127.0.0.1:9050
+
+# Seconds to wait for connections and between received data, and the maximum
+# number of seconds that each download (including its retries), zone transfer,
+# or git fetch can take (0 for no limit). The latter can be overridden per
+# source via timeout=.
+CONNECT_TIMEOUT=15
+READ_TIMEOUT=60
+FETCH_TIMEOUT=600
+
+# Number of times to retry failed downloads (overridable per source via
+# retries=), and the initial and maximum number of seconds to wait between
+# attempts. The delay doubles after each attempt.
+FETCH_RETRIES=3
+RETRY_DELAY=5
+MAX_RETRY_DELAY=300
+
+# Built-in profile used instead of DENY_URLS if non-empty. See --profile.
+PROFILE=
+PROFILES="minimal standard strict family"
+
+# Zones that are never blocked, since doing so would break name resolution,
+# time synchronization, OS updates, or captive portal detection. Zones from
+# sources that are within these zones are dropped, and the zones are allowed
+# like literal allow patterns, so they still resolve if a parent zone is
+# blocked.
+SAFE_ZONES="
+  root-servers.net gtld-servers.net root-servers.org iana-servers.net
+  pool.ntp.org time.apple.com time.windows.com time.google.com
+  time.cloudflare.com ntp.ubuntu.com
+  windowsupdate.com update.microsoft.com delivery.mp.microsoft.com
+  swscan.apple.com swcdn.apple.com mesu.apple.com
+  deb.debian.org security.debian.org archive.ubuntu.com security.ubuntu.com
+  connectivitycheck.gstatic.com connectivitycheck.android.com
+  clients3.google.com captive.apple.com www.msftconnecttest.com
+  www.msftncsi.com detectportal.firefox.com nmcheck.gnome.org
+  connectivity-check.ubuntu.com
+"
+
+# If non-empty, literally allowed domains are resolved with dig, and the targets
+# of their CNAME chains are also allowed (but not the zones containing them).
+# This keeps allowed sites working when they point at blocked tracking or CDN
+# names.
+UNCLOAK_CNAMES=
+
+# Whitespace-separated top-level domains to block entirely (e.g. "zip top"),
+# which are used as an additional source with the URL "tlds:TLD[,TLD]...".
+# Single-label zones from other sources are dropped with a warning, so whole
+# TLDs are only blocked when listed here.
+BLOCK_TLDS=
+
+# If non-empty, the CANARY_ZONES canary domains are answered with NXDOMAIN,
+# telling Firefox not to enable DNS-over-HTTPS and iCloud Private Relay not to
+# bypass the local resolver. They're listed as an additional "canaries:" source.
+CANARIES=
+CANARY_ZONES="use-application-dns.net mask.icloud.com mask-h2.icloud.com"
+
+# If non-empty, Unbound and RPZ output redirects the names in
+# SAFESEARCH_REDIRECTS to the CNAME targets that enforce SafeSearch or
+# Restricted Mode. The names and their targets are dropped from the sources.
+SAFESEARCH=
+SAFESEARCH_REDIRECTS="
+  www.google.com forcesafesearch.google.com
+  www.bing.com strict.bing.com
+  duckduckgo.com safe.duckduckgo.com
+  www.duckduckgo.com safe.duckduckgo.com
+  www.youtube.com restrict.youtube.com
+  m.youtube.com restrict.youtube.com
+  youtubei.googleapis.com restrict.youtube.com
+  youtube.googleapis.com restrict.youtube.com
+  www.youtube-nocookie.com restrict.youtube.com
+"
+
+# If non-empty, the public DNS-over-HTTPS and DNS-over-TLS resolvers listed at
+# DOH_URL are also blocked (in the "doh" category), so clients can't bypass
+# the blocklist by switching to them.
+BLOCK_DOH=
+DOH_URL=https://raw.githubusercontent.com/derat/dns-lists/master/doh-servers
+
+# URL of the Public Suffix List. Zones that are public suffixes (e.g. "co.uk"
+# or "github.io") are dropped with a warning unless their sources have the
+# public-suffixes=yes option. Empty to not check zones against the list.
+PSL_URL=https://publicsuffix.org/list/public_suffix_list.dat
+
+# If non-empty, omit zones whose parent zones are also blocked.
+COLLAPSE_SUBDOMAINS=1
+
+# Minimum number of sources that must list a zone for it to be blocked.
+MIN_SOURCES=1
+
+# If positive, zones are only blocked if the weights of the sources listing
+# them (see the weight= option) add up to at least this score, so low-quality
+# lists with small weights can't block zones by themselves.
+MIN_SCORE=0
+
+# If positive, zones are replaced by their registrable domains (e.g.
+# "example.co.uk" for "ads.example.co.uk", per the Public Suffix List) when
+# more than this many zones are listed under the same registrable domain. This
+# blocks more names but makes the output much smaller.
+ROLLUP_THRESHOLD=0
+
+# Maximum number of zones to block (0 for no limit), e.g. for routers without
+# enough memory for large lists. When there are more zones, the ones in the
+# comma-separated PRIORITY_CATEGORIES are kept first, followed by ones from
+# sources with higher priority= options, ones listed by more sources, and ones
+# from earlier sources.
+MAX_ZONES=0
+PRIORITY_CATEGORIES=
+
+# Whitespace-separated CATEGORY=ACTION pairs (e.g. "malware=always_nxdomain
+# adult=redirect") with the Unbound local-zone types used for entries in the
+# categories, overriding their sources' actions. "audit" can't be used.
+CATEGORY_ACTIONS=
+
+# Whitespace-separated CATEGORY=SCHEDULE pairs (e.g.
+# "social=sun-thu@21:00-07:00") limiting entries in the categories to the
+# times in the schedules, which use the schedule= source option's format. They
+# only apply to sources without schedule= or clients= options and to zones
+# that no other source blocks at all times, and not to the "redirect" action
+# (Unbound output only; see the "schedule" command).
+CATEGORY_SCHEDULES=
+
+# Comma-separated categories of entries to block, or empty to block all entries.
+# "uncategorized" matches entries without categories.
+CATEGORIES=
+
+usage() {
+  cat <<EOF >&2
+Usage: $0 [option]... [validate|schedule]
+  -c, --config FILE      read settings from a shell script assigning the
+                         uppercase variables documented in this script (not
+                         YAML or TOML); read before other options, which take
+                         precedence
+  -n, --dry-run          write output to a temporary directory and exit
+  -f, --format FORMAT    output format (${FORMATS})
+  -a, --action TYPE      default Unbound local-zone type for blocked zones
+                         (${ACTION})
+      --annotate         list each zone's sources in comments
+      --sinkhole IP[,IP]...
+                         answer queries for blocked zones with these addresses
+  -o, --output [FORMAT=]PATH
+                         output path (stdout for non-Unbound formats); may be
+                         repeated with different formats to write several
+                         outputs in one run
+  -j, --jobs N           fetch up to N sources at once (${FETCH_JOBS})
+      --jitter SECONDS   wait up to SECONDS at random before fetching
+      --stagger SECONDS  wait SECONDS between downloads from the same host
+      --timeout SECONDS  maximum time to fetch each source (${FETCH_TIMEOUT})
+      --proxy URL        HTTP or SOCKS5 proxy for downloads
+      --tor              fetch sources through Tor (${TOR_PROXY})
+      --bootstrap-dns SERVER
+                         DNS server address or DoH URL used to resolve
+                         download hosts
+      --user-agent AGENT User-Agent header for downloads
+      --limit-rate RATE  maximum speed of each download, e.g. "200k"
+      --max-staleness SECONDS
+                         maximum age of cached lists used when downloads fail
+                         (${MAX_STALENESS})
+  -t, --template FILE    write output using a Go-style text/template file
+      --chunk-size N     split the Unbound config into files of N zones each
+      --split-sources    split the Unbound config into one file per source
+      --report PATH      write a Markdown report (HTML if PATH ends in .html)
+      --manifest PATH    write a JSON summary of the sources and zones
+      --feed PATH        write an Atom feed of the zones added and removed by
+                         each run
+      --publish-dir DIR  also write plain and compressed copies of the outputs
+                         to DIR (see PUBLISH_DIR)
+      --min-sources N    only block zones listed by at least N sources
+      --min-score SCORE  only block zones whose sources' weights add up to at
+                         least SCORE
+      --max-zones N      block at most N zones (see MAX_ZONES)
+      --rollup N         block registrable domains with more than N zones
+                         under them instead (see ROLLUP_THRESHOLD)
+      --no-collapse      keep zones whose parent zones are also blocked
+      --block-tld TLD    block a whole top-level domain; may be repeated
+      --uncloak          also allow CNAME targets of allowed domains
+      --canaries         answer DoH and Private Relay canary domains with
+                         NXDOMAIN
+      --safesearch       enforce SafeSearch for Google, Bing, DuckDuckGo, and
+                         YouTube (Unbound and RPZ only)
+      --block-doh        block public DoH and DoT resolvers (see BLOCK_DOH)
+      --profile NAME     use a built-in set of deny lists instead of DENY_URLS
+                         (${PROFILES})
+      --categories CATEGORY[,CATEGORY]...
+                         only block entries in these categories (see
+                         CATEGORIES)
+      --category-action CATEGORY=ACTION
+                         use a different action for entries in a category;
+                         may be repeated
+      --category-schedule CATEGORY=SCHEDULE
+                         only block entries in a category at the times in
+                         SCHEDULE (see CATEGORY_SCHEDULES); may be repeated
+      --stdin-format FORMAT
+                         also read a deny list in FORMAT from stdin
+      --deny-url 'URL [OPTION]...'
+                         also use a deny list (see DENY_URLS); may be repeated
+      --allow-url URL    also use an allow list; may be repeated
+      --deny-pattern-url URL
+                         also use a list of deny patterns; may be repeated
+      --deny-keyword WORD
+                         also use a deny keyword; may be repeated
+      --deny-file PATH   also use a local deny list; may be repeated
+      --allow-file PATH  also use a local allow list; may be repeated
+      --no-default-sources
+                         don't use the built-in deny and allow lists
+      --unbound-config PATH
+                         path of the installed Unbound config (${CONFIG})
+      --checkconf-cmd CMD
+                         command run with the new config's path to validate it
+                         (${CHECKCONF_CMD})
+      --main-config PATH path of Unbound's main config, which is also checked
+                         with the new files in place (${MAIN_CONFIG})
+      --owner USER[:GROUP]
+                         owner of the installed files
+      --mode MODE        mode of the installed files (${FILE_MODE})
+      --chroot DIR       directory that Unbound chroots to (see UNBOUND_CHROOT)
+      --reload-cmd CMD   command run to make Unbound reload its config
+                         (${RELOAD_CMD})
+      --incremental N    apply up to N zone changes with unbound-control
+                         instead of reloading (see INCREMENTAL_MAX_CHANGES)
+
+The "validate" command checks the settings, sources, and local allow patterns
+and exits without fetching or writing anything.
+
+The "schedule" command uses unbound-control to add and remove the zones of
+sources with schedule= options and of CATEGORY_SCHEDULES categories as their
+schedules start and end. The zones of sources that also have clients= options
+are switched between their actions and "transparent" instead. Run it every
+minute, e.g. from cron, with the same STATE_DIR as the updates.
+EOF
+  exit 2
+}
+
+# Print the deny lists used by the built-in profile named $1 in DENY_URLS's
+# format. Returns 1 if the profile doesn't exist.
+profile_sources() {
+  sb=https://raw.githubusercontent.com/StevenBlack/hosts/master
+  derat=https://raw.githubusercontent.com/derat/dns-lists/master/deny-hosts
+  urlhaus="https://urlhaus.abuse.ch/downloads/hostfile/"
+  urlhaus="${urlhaus} sink=127.0.0.1 categories=malware"
+  case "$1" in
+    # Just ad and tracking servers.
+    minimal) echo "$derat" ;;
+    # The default lists.
+    standard) printf '%s\n' "$derat" "${sb}/hosts" ;;
+    # Also block malware hosts, returning NXDOMAIN instead of REFUSED.
+    strict)
+      printf '%s\n' "$derat" "${sb}/alternates/fakenews-gambling/hosts" \
+        "${urlhaus} action=always_nxdomain"
+      ;;
+    # Also block adult content, gambling, and malware.
+    family)
+      printf '%s\n' "$derat" \
+        "${sb}/alternates/fakenews-gambling-porn/hosts" \
+        "${urlhaus} action=always_nxdomain"
+      ;;
+    *) return 1 ;;
+  esac
+}
+
+# Settings that can be overridden via BLOCKLIST_* environment variables.
+ENV_SETTINGS="
+  DENY_URLS ALLOW_URLS DENY_PATTERN_URLS DENY_KEYWORDS
+  CONFIG RPZ_ZONEFILE RPZ_NAME CHUNK_DIR FILE_OWNER FILE_MODE UNBOUND_CHROOT
+  STATE_DIR PUBLISH_DIR
+  CHECKCONF_CMD MAIN_CONFIG RELOAD_CMD
+  HEALTH_TIMEOUT HEALTH_SERVER HEALTH_ALLOWED INCREMENTAL_MAX_CHANGES
+  FORMAT ANNOTATE ACTION SINKHOLE CLIENT_TAGS
+  PROFILE CATEGORIES CATEGORY_ACTIONS CATEGORY_SCHEDULES
+  MIN_SOURCES MIN_SCORE COLLAPSE_SUBDOMAINS ROLLUP_THRESHOLD
+  MAX_ZONES PRIORITY_CATEGORIES SAFE_ZONES UNCLOAK_CNAMES
+  BLOCK_TLDS CANARIES SAFESEARCH BLOCK_DOH DOH_URL PSL_URL
+  FETCH_JOBS JITTER STAGGER CONNECT_TIMEOUT READ_TIMEOUT FETCH_TIMEOUT
+  FETCH_RETRIES RETRY_DELAY MAX_RETRY_DELAY MAX_STALENESS
+  PROXY TOR_PROXY USER_AGENT MAX_SOURCE_SIZE BOOTSTRAP_DNS RATE_LIMIT
+"
+
+# Load the config file before handling other flags so they can override it.
+configfile=$BLOCKLIST_CONFIG_FILE
+prev=
+for arg in "$@"; do
+  case "$prev" in
+    -c|--config) configfile=$arg ;;
+  esac
+  prev=$arg
+done
+if [ -n "$configfile" ]; then
+  case "$configfile" in
+    */*) . "$configfile" ;;
+    *) . "./${configfile}" ;;
+  esac
+fi
+for v in $ENV_SETTINGS; do
+  eval "[ -z \"\${BLOCKLIST_${v}+set}\" ] || ${v}=\$BLOCKLIST_${v}"
+done
+
 dryrun=
-if [ "$1" = '-n' ] || [ "$1" = '--dry-run' ]; then
-  dryrun=1
-elif [ "$#" -ge 1 ]; then
-  echo "Usage: $0 [-n|--dry-run]" >&2
+validate=
+schedule=
+format=$FORMAT
+outputs=
+template=
+chunksize=
+splitsources=
+nodefaults=
+denyurls=
+allowurls=
+while [ "$#" -gt 0 ]; do
+  case "$1" in
+    -c|--config) [ "$#" -ge 2 ] || usage; shift ;;
+    -n|--dry-run) dryrun=1 ;;
+    -f|--format) [ "$#" -ge 2 ] || usage; format=$2; shift ;;
+    -a|--action) [ "$#" -ge 2 ] || usage; ACTION=$2; shift ;;
+    --annotate) ANNOTATE=1 ;;
+    --sinkhole) [ "$#" -ge 2 ] || usage; SINKHOLE=$2; ACTION=redirect; shift ;;
+    -o|--output)
+      [ "$#" -ge 2 ] || usage
+      outputs="${outputs}${2}
+"
+      shift
+      ;;
+    -t|--template) [ "$#" -ge 2 ] || usage; template=$2; shift ;;
+    --chunk-size) [ "$#" -ge 2 ] || usage; chunksize=$2; shift ;;
+    --split-sources) splitsources=1 ;;
+    --stdin-format)
+      [ "$#" -ge 2 ] || usage
+      denyurls="${denyurls}
+- format=${2}"
+      shift
+      ;;
+    --deny-url)
+      [ "$#" -ge 2 ] || usage
+      denyurls="${denyurls}
+${2}"
+      shift
+      ;;
+    --allow-url)
+      [ "$#" -ge 2 ] || usage
+      allowurls="${allowurls}
+${2}"
+      shift
+      ;;
+    --deny-pattern-url)
+      [ "$#" -ge 2 ] || usage
+      DENY_PATTERN_URLS="${DENY_PATTERN_URLS}
+${2}"
+      shift
+      ;;
+    --deny-keyword)
+      [ "$#" -ge 2 ] || usage
+      DENY_KEYWORDS="${DENY_KEYWORDS} ${2}"
+      shift
+      ;;
+    --deny-file|--allow-file)
+      [ "$#" -ge 2 ] || usage
+      if [ ! -r "$2" ]; then
+        echo "Can't read ${2}" >&2
+        exit 2
+      fi
+      # Use an absolute path so it isn't mistaken for a URL.
+      if [ "$1" = --deny-file ]; then
+        denyurls="${denyurls}
+$(readlink -f "$2")"
+      else
+        allowurls="${allowurls}
+$(readlink -f "$2")"
+      fi
+      shift
+      ;;
+    --no-default-sources) nodefaults=1 ;;
+    --categories) [ "$#" -ge 2 ] || usage; CATEGORIES=$2; shift ;;
+    --category-action)
+      [ "$#" -ge 2 ] || usage
+      CATEGORY_ACTIONS="${CATEGORY_ACTIONS} ${2}"
+      shift
+      ;;
+    --category-schedule)
+      [ "$#" -ge 2 ] || usage
+      CATEGORY_SCHEDULES="${CATEGORY_SCHEDULES} ${2}"
+      shift
+      ;;
+    --min-sources) [ "$#" -ge 2 ] || usage; MIN_SOURCES=$2; shift ;;
+    --min-score) [ "$#" -ge 2 ] || usage; MIN_SCORE=$2; shift ;;
+    --max-zones) [ "$#" -ge 2 ] || usage; MAX_ZONES=$2; shift ;;
+    --rollup) [ "$#" -ge 2 ] || usage; ROLLUP_THRESHOLD=$2; shift ;;
+    --no-collapse) COLLAPSE_SUBDOMAINS= ;;
+    --block-tld)
+      [ "$#" -ge 2 ] || usage
+      BLOCK_TLDS="${BLOCK_TLDS} ${2}"
+      shift
+      ;;
+    --uncloak) UNCLOAK_CNAMES=1 ;;
+    --canaries) CANARIES=1 ;;
+    --safesearch) SAFESEARCH=1 ;;
+    --block-doh) BLOCK_DOH=1 ;;
+    --profile) [ "$#" -ge 2 ] || usage; PROFILE=$2; shift ;;
+    -j|--jobs) [ "$#" -ge 2 ] || usage; FETCH_JOBS=$2; shift ;;
+    --jitter) [ "$#" -ge 2 ] || usage; JITTER=$2; shift ;;
+    --stagger) [ "$#" -ge 2 ] || usage; STAGGER=$2; shift ;;
+    --timeout) [ "$#" -ge 2 ] || usage; FETCH_TIMEOUT=$2; shift ;;
+    --max-staleness) [ "$#" -ge 2 ] || usage; MAX_STALENESS=$2; shift ;;
+    --proxy) [ "$#" -ge 2 ] || usage; PROXY=$2; shift ;;
+    --tor) PROXY=$TOR_PROXY ;;
+    --bootstrap-dns) [ "$#" -ge 2 ] || usage; BOOTSTRAP_DNS=$2; shift ;;
+    --user-agent) [ "$#" -ge 2 ] || usage; USER_AGENT=$2; shift ;;
+    --limit-rate) [ "$#" -ge 2 ] || usage; RATE_LIMIT=$2; shift ;;
+    --unbound-config) [ "$#" -ge 2 ] || usage; CONFIG=$2; shift ;;
+    --checkconf-cmd) [ "$#" -ge 2 ] || usage; CHECKCONF_CMD=$2; shift ;;
+    --main-config) [ "$#" -ge 2 ] || usage; MAIN_CONFIG=$2; shift ;;
+    --owner) [ "$#" -ge 2 ] || usage; FILE_OWNER=$2; shift ;;
+    --mode) [ "$#" -ge 2 ] || usage; FILE_MODE=$2; shift ;;
+    --chroot) [ "$#" -ge 2 ] || usage; UNBOUND_CHROOT=$2; shift ;;
+    --reload-cmd) [ "$#" -ge 2 ] || usage; RELOAD_CMD=$2; shift ;;
+    --incremental) [ "$#" -ge 2 ] || usage; INCREMENTAL_MAX_CHANGES=$2; shift ;;
+    --report)
+      [ "$#" -ge 2 ] || usage
+      outputs="${outputs}report=${2}
+"
+      shift
+      ;;
+    --publish-dir) [ "$#" -ge 2 ] || usage; PUBLISH_DIR=$2; shift ;;
+    --manifest)
+      [ "$#" -ge 2 ] || usage
+      outputs="${outputs}manifest=${2}
+"
+      shift
+      ;;
+    --feed)
+      [ "$#" -ge 2 ] || usage
+      outputs="${outputs}feed=${2}
+"
+      shift
+      ;;
+    validate) validate=1 ;;
+    schedule) schedule=1 ;;
+    *) usage ;;
+  esac
+  shift
+done
+if [ -n "$UNBOUND_CHROOT" ]; then
+  for v in CONFIG CHUNK_DIR RPZ_ZONEFILE MAIN_CONFIG; do
+    eval "${v}=\"\${UNBOUND_CHROOT%/}\$${v}\""
+  done
+fi
+if [ -n "$PROFILE" ]; then
+  if ! DENY_URLS=$(profile_sources "$PROFILE"); then
+    echo "Unknown profile '${PROFILE}'" >&2
+    exit 2
+  fi
+fi
+if [ -n "$nodefaults" ]; then
+  DENY_URLS=
+  ALLOW_URLS=
+fi
+DENY_URLS="${DENY_URLS}${denyurls}"
+if [ -n "$BLOCK_DOH" ]; then
+  DENY_URLS="${DENY_URLS}
+${DOH_URL} format=domains categories=doh"
+fi
+# wget only looks at the lowercase proxy variables.
+for v in http_proxy https_proxy no_proxy; do
+  uv=$(echo "$v" | tr a-z A-Z)
+  eval "[ -n \"\$${v}\" ] || [ -z \"\$${uv}\" ] || export ${v}=\"\$${uv}\""
+done
+ALLOW_URLS="${ALLOW_URLS}${allowurls}"
+[ -n "$template" ] && format=template
+# Only write the default output if the report, manifest, and feed are the only
+# ones requested.
+[ -z "$(echo "$outputs" | grep -v -e '^report=' -e '^manifest=' -e '^feed=' \
+  -e '^$')" ] && \
+  outputs="=
+${outputs}"
+
+# Return success if $1 is a schedule in the form described for the schedule=
+# source option.
+valid_schedule() {
+  day='(sun|mon|tue|wed|thu|fri|sat)'
+  time='([01][0-9]|2[0-3]):[0-5][0-9]'
+  echo "$1" | grep -q -E \
+    "^(${day}(-${day})?(,${day}(-${day})?)*@)?${time}-${time}\$"
+}
+
+if ! echo "$FILE_MODE" | grep -q -E '^[0-7]{3,4}$'; then
+  echo "Invalid file mode '${FILE_MODE}'" >&2
+  exit 2
+fi
+if ! [ "$FETCH_JOBS" -gt 0 ] 2>/dev/null; then
+  echo "Invalid number of jobs '${FETCH_JOBS}'" >&2
+  exit 2
+fi
+for v in JITTER STAGGER MIN_SOURCES MAX_ZONES ROLLUP_THRESHOLD \
+    HEALTH_TIMEOUT INCREMENTAL_MAX_CHANGES; do
+  if ! eval "[ \"\$${v}\" -ge 0 ]" 2>/dev/null; then
+    echo "Invalid ${v} value" >&2
+    exit 2
+  fi
+done
+if ! echo "$MIN_SCORE" | grep -qE '^[0-9]+(\.[0-9]+)?$'; then
+  echo "Invalid minimum score '${MIN_SCORE}'" >&2
+  exit 2
+fi
+if [ "$ROLLUP_THRESHOLD" -gt 0 ] && [ -z "$PSL_URL" ]; then
+  echo "ROLLUP_THRESHOLD requires PSL_URL" >&2
+  exit 2
+fi
+if ! [ "$FETCH_TIMEOUT" -ge 0 ] 2>/dev/null; then
+  echo "Invalid timeout '${FETCH_TIMEOUT}'" >&2
+  exit 2
+fi
+if ! [ "$MAX_SOURCE_SIZE" -ge 0 ] 2>/dev/null; then
+  echo "Invalid max source size '${MAX_SOURCE_SIZE}'" >&2
+  exit 2
+fi
+if ! [ "$MAX_STALENESS" -ge 0 ] 2>/dev/null; then
+  echo "Invalid max staleness '${MAX_STALENESS}'" >&2
+  exit 2
+fi
+if ! echo " ${ACTIONS} " | grep -q " ${ACTION} "; then
+  echo "Unknown action '${ACTION}'" >&2
+  exit 2
+fi
+for p in $CLIENT_TAGS; do
+  if ! echo "$p" | grep -qE '^[-_a-zA-Z0-9]+=[^=]+$'; then
+    echo "Invalid client tag '${p}'" >&2
+    exit 2
+  fi
+done
+for p in $CATEGORY_ACTIONS; do
+  a=${p#*=}
+  if [ "$a" = "$p" ] || [ "$a" = audit ] || \
+      ! echo " ${ACTIONS} " | grep -q " ${a} "; then
+    echo "Invalid category action '${p}'" >&2
+    exit 2
+  elif [ "$a" = redirect ] && [ -z "$SINKHOLE" ]; then
+    echo "Category action '${p}' requires SINKHOLE" >&2
+    exit 2
+  fi
+done
+for p in $CATEGORY_SCHEDULES; do
+  if ! echo "$p" | grep -qE '^[-_a-zA-Z0-9]+=' || \
+      ! valid_schedule "${p#*=}"; then
+    echo "Invalid category schedule '${p}'" >&2
+    exit 2
+  fi
+done
+if [ -n "$chunksize" ] && ! [ "$chunksize" -gt 0 ] 2>/dev/null; then
+  echo "Invalid chunk size '${chunksize}'" >&2
+  exit 2
+fi
+if [ -n "$chunksize" ] && [ -n "$splitsources" ]; then
+  echo "--chunk-size and --split-sources can't be used together" >&2
+  exit 2
+fi
+
+# Build a list of "FORMAT PATH" lines describing the outputs to write. An empty
+# path means the default location for the format.
+targets=
+while read -r o; do
+  [ -z "$o" ] && continue
+  [ "$o" = '=' ] && o=
+  f=$format
+  case " ${FORMATS} template report manifest feed " in
+    *" ${o%%=*} "*) [ "${o#*=}" != "$o" ] && f=${o%%=*} && o=${o#*=} ;;
+  esac
+  case " ${FORMATS} template report manifest feed " in
+    *" ${f} "*) ;;
+    *) echo "Unknown format '${f}'" >&2; exit 2 ;;
+  esac
+  targets="${targets}${f} ${o}
+"
+done <<EOF
+$outputs
+EOF
+targets=$(echo "$targets" | grep -v '^$')
+if [ "$(echo "$targets" | grep -c -E '^(unbound|rpz) ')" -gt 1 ]; then
+  echo "Only one Unbound config can be written" >&2
+  exit 2
+fi
+if [ -n "$CATEGORY_SCHEDULES" ] && ! echo "$targets" | grep -q '^unbound '; then
+  echo "CATEGORY_SCHEDULES requires Unbound output" >&2
+  exit 2
+fi
+if [ -z "$template" ] && echo "$targets" | grep -q '^template '; then
+  echo "Template output requires --template" >&2
   exit 2
 fi
 
 tmpdir=$(mktemp -d --tmpdir update_blocklist.XXXXXX)
 [ -z "$dryrun" ] && trap "rm -r '$tmpdir'" EXIT
 
-# We can safely drop everything after '#' since it isn't allowed in domain names.
-allow="${tmpdir}/allow"
-wget --quiet -O- "$ALLOW_URL" | \
-  sed -e 's/#.*//' | sed -e 's/^\s*//' | sed -e 's/\s*$//' | \
-  grep -v '^$' >"${allow}"
-
-# The 'server:' directive here is required.
-out="${tmpdir}/out"
-cat <<EOF >"$out"
-# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)
-server:
+# Decompress gzip- or zstd-compressed data from stdin to stdout based on its
+# magic number. Uncompressed data is copied unchanged. Returns the
+# decompressor's status, e.g. for truncated data or if zstd isn't installed.
+decompress() {
+  data=$(mktemp "${tmpdir}/data.XXXXXX")
+  cat >"$data"
+  st=0
+  case "$(od -An -tx1 -N4 "$data" | tr -d ' ')" in
+    1f8b*) gzip -dc "$data" || st=$? ;;
+    28b52ffd) zstd -dc "$data" || st=$? ;;
+    *) cat "$data" || st=$? ;;
+  esac
+  rm -f "$data"
+  return "$st"
+}
+
+# Decompress the file at $1 to stdout like decompress, ending it with a newline
+# if it doesn't already end with one. This keeps the last line of one file from
+# being merged with the first line of the next when files are concatenated.
+decompress_file() {
+  lines=$(mktemp "${tmpdir}/lines.XXXXXX")
+  decompress <"$1" >"$lines" || return 1
+  cat "$lines"
+  if [ -n "$(tail -c 1 "$lines")" ]; then
+    echo
+  fi
+  rm -f "$lines"
+}
+
+# Run the command in $2 and the following arguments, killing it if it takes
+# longer than allowed by the source options in $1.
+fetch_timeout() {
+  t=$(source_opt "$1" timeout "$FETCH_TIMEOUT")
+  shift
+  timeout "$t" "$@"
+}
+
+# Print the value of the last response header named $1 (in lowercase) in the
+# wget log at $2.
+log_header() {
+  awk -v name="${1}:" 'tolower($1) == name {
+    sub(/^[ \t]*[^:]*:[ \t]*/, "")
+    sub(/\r$/, "")
+    v = $0
+  } END { print v }' "$2"
+}
+
+# If $PROXY is a SOCKS proxy, print a command prefix that runs a program with
+# its connections (and DNS lookups) redirected through it by torsocks.
+socks_wrap() {
+  case "$PROXY" in
+    socks*://*)
+      hostport=${PROXY#*://}
+      hostport=${hostport%/}
+      echo "env TORSOCKS_TOR_ADDRESS=${hostport%:*}" \
+        "TORSOCKS_TOR_PORT=${hostport##*:} torsocks"
+      ;;
+  esac
+}
+
+# Download to the file at $2 using wget with the remaining arguments, which
+# should end with the URL. $1 contains source options. If $wgetrc is
+# non-empty, it's used as additional wgetrc commands. Network errors,
+# timeouts, and 429 and 5xx responses are retried with exponential backoff,
+# or after the delay requested by a Retry-After header; wget's own retries are
+# disabled. The source's timeout covers all of the attempts and delays, and
+# retrying stops once there's no time left for it. A 304 response counts as
+# success. The final response's status code and ETag, Last-Modified, and
+# Content-Type headers are saved in $fcode, $fetag, $flastmod, and $fctype.
+fetch_wget() {
+  fo=$1
+  fout=$2
+  shift 2
+  tries=$(source_opt "$fo" retries "$FETCH_RETRIES")
+  delay=$RETRY_DELAY
+  limit=$(source_opt "$fo" timeout "$FETCH_TIMEOUT")
+  deadline=$(($(date +%s) + limit))
+  log=$(mktemp "${tmpdir}/wget-log.XXXXXX")
+  # Per-source settings come later, so they take precedence.
+  rclines="user_agent = ${USER_AGENT}
+${RATE_LIMIT:+limit_rate = ${RATE_LIMIT}
+}${wgetrc}"
+  # wget doesn't support SOCKS, so socks_wrap's torsocks command is used then.
+  wrap=$(socks_wrap)
+  case "$PROXY" in
+    ""|socks*://*) ;;
+    *)
+      rclines="${rclines}
+http_proxy = ${PROXY}
+https_proxy = ${PROXY}
+use_proxy = on"
+      ;;
+  esac
+  rc=$(mktemp "${tmpdir}/wgetrc.XXXXXX")
+  echo "$rclines" >"$rc"
+  while :; do
+    st=0
+    # Each attempt only gets what's left of the timeout (0 for no limit).
+    left=0
+    if [ "$limit" -ne 0 ]; then
+      left=$((deadline - $(date +%s)))
+      [ "$left" -gt 0 ] || left=1
+    fi
+    # A SOCKS proxy resolves hostnames itself.
+    if [ -n "$BOOTSTRAP_DNS" ] && [ -z "$wrap" ]; then
+      fetch_curl "$log" "$rc" "$fout" "$left" "$@" || st=$?
+    else
+      timeout "$left" $wrap wget --server-response --output-file="$log" \
+        --config="$rc" --tries=1 \
+        --connect-timeout="$CONNECT_TIMEOUT" --read-timeout="$READ_TIMEOUT" \
+        -O "$fout" "$@" || st=$?
+    fi
+    fcode=$(awk '$1 ~ /^HTTP\// { c = $2 } END { print c }' "$log")
+    fetag=$(log_header etag "$log")
+    flastmod=$(log_header last-modified "$log")
+    fctype=$(log_header content-type "$log")
+    if [ "$st" -eq 0 ] || [ "$fcode" = 304 ]; then
+      rm -f "$log" "$rc"
+      return 0
+    fi
+    code=$fcode
+    after=$(awk 'tolower($1) == "retry-after:" && $2 ~ /^[0-9]+$/ { a = $2 }
+      END { print a }' "$log")
+    pause=${after:-$delay}
+    [ "$pause" -le "$MAX_RETRY_DELAY" ] || pause=$MAX_RETRY_DELAY
+    # wget exits with 4 for network failures, 8 for error responses, and
+    # timeout exits with 124.
+    if [ "$tries" -le 0 ] || ! { [ "$st" -eq 4 ] || [ "$st" -eq 124 ] ||
+        { [ "$st" -eq 8 ] && echo "$code" | grep -q '^\(429\|5..\)$'; }; } ||
+        { [ "$limit" -ne 0 ] &&
+          [ $((deadline - $(date +%s))) -le "$pause" ]; }; then
+      # Show wget's error message, since its output was redirected.
+      grep -E 'ERROR|failed' "$log" | tail -n 1 >&2
+      rm -f "$log" "$rc"
+      return 1
+    fi
+    for furl; do :; done
+    echo "Retrying ${furl} in ${pause} seconds" >&2
+    sleep "$pause"
+    tries=$((tries - 1))
+    delay=$((delay * 2))
+  done
+}
+
+# Download to the file at $3 using curl, resolving the URL's host via
+# $BOOTSTRAP_DNS instead of the system resolver. $1 and $2 are the log and
+# wgetrc files that would be passed to wget and $4 is the maximum time in
+# seconds. The remaining arguments are fetch_wget's wget arguments. Returns the
+# status that wget would have.
+fetch_curl() {
+  clog=$1
+  crc=$2
+  cout=$3
+  maxtime=$4
+  shift 4
+  ccfg=$(mktemp "${tmpdir}/curlrc.XXXXXX")
+  # Translate the wgetrc commands. Proxies come from $PROXY instead.
+  awk '
+    function q(s) {
+      gsub(/\\/, "\\\\", s)
+      gsub(/"/, "\\\"", s)
+      return "\"" s "\""
+    }
+    { k = $1; v = $0; sub(/^[^=]*=[ \t]*/, "", v) }
+    k == "header" { print "header = " q(v) }
+    k == "user_agent" { print "user-agent = " q(v) }
+    k == "ca_certificate" { print "cacert = " q(v) }
+    k == "limit_rate" { print "limit-rate = " q(v) }
+    k == "pinnedpubkey" { print "pinnedpubkey = " q(v) }
+    k == "secure_protocol" {
+      sub(/^TLSv/, "", v)
+      gsub(/_/, ".", v)
+      print "tlsv" v
+    }
+    k == "user" { user = v }
+    k == "password" { pass = v }
+    END { if (user != "") print "user = " q(user ":" pass) }' "$crc" >"$ccfg"
+  [ -n "$PROXY" ] && echo "proxy = \"${PROXY}\"" >>"$ccfg"
+  n=$#
+  curl=
+  while [ "$n" -gt 0 ]; do
+    a=$1
+    shift
+    n=$((n - 1))
+    case "$a" in
+      --compression=auto) set -- "$@" --compressed ;;
+      --header=*) set -- "$@" --header "${a#--header=}" ;;
+      --post-data=*) set -- "$@" --data-raw "${a#--post-data=}" ;;
+      *) curl=$a; set -- "$@" "$a" ;;
+    esac
+  done
+  case "$BOOTSTRAP_DNS" in
+    https://*) set -- --doh-url "$BOOTSTRAP_DNS" "$@" ;;
+    *)
+      chost=${curl#*://}
+      chost=${chost%%[/?#]*}
+      case "$chost" in
+        *:*) cport=${chost##*:}; chost=${chost%:*} ;;
+        *) cport=443; [ "${curl%%://*}" = http ] && cport=80 ;;
+      esac
+      ip=$(dig +short +timeout="$CONNECT_TIMEOUT" @"$BOOTSTRAP_DNS" \
+        "$chost" A | grep -E '^[0-9.]+$' | tail -n 1)
+      if [ -z "$ip" ]; then
+        echo "Couldn't resolve ${chost} via ${BOOTSTRAP_DNS}" >&2
+        return 4
+      fi
+      set -- --resolve "${chost}:${cport}:${ip}" "$@"
+      ;;
+  esac
+  curl --silent --show-error --fail --location --dump-header "$clog" \
+    --config "$ccfg" --connect-timeout "$CONNECT_TIMEOUT" \
+    --speed-limit 1 --speed-time "$READ_TIMEOUT" --max-time "$maxtime" \
+    -o "$cout" "$@"
+  case "$?" in
+    0) return 0 ;;
+    22) return 8 ;;
+    28) return 124 ;;
+    *) return 4 ;;
+  esac
+}
+
+# Print wgetrc commands supplying the credentials and extra headers from the
+# source options in $1.
+source_wgetrc() {
+  creds=$(source_opt "$1" auth-file)
+  var=$(source_opt "$1" auth-env)
+  if [ -n "$creds" ]; then
+    creds=$(cat "$creds")
+  elif [ -n "$var" ]; then
+    eval "creds=\$${var}"
+  fi
+  if [ -n "$creds" ]; then
+    echo "user = ${creds%%:*}"
+    echo "password = ${creds#*:}"
+  fi
+  token=$(source_opt "$1" token-file)
+  var=$(source_opt "$1" token-env)
+  if [ -n "$token" ]; then
+    token=$(cat "$token")
+  elif [ -n "$var" ]; then
+    eval "token=\$${var}"
+  fi
+  if [ -n "$token" ]; then
+    echo "header = Authorization: Bearer ${token}"
+  fi
+  for o in $1; do
+    case "$o" in
+      header=*:*)
+        h=${o#header=}
+        echo "header = ${h%%:*}: ${h#*:}"
+        ;;
+      user-agent=*) echo "user_agent = ${o#*=}" ;;
+      ca-file=*) echo "ca_certificate = ${o#*=}" ;;
+      pin=*) echo "pinnedpubkey = ${o#*=}" ;;
+      limit-rate=*) echo "limit_rate = ${o#*=}" ;;
+      tls-min=*) echo "secure_protocol = TLSv$(echo "${o#*=}" | tr . _)" ;;
+    esac
+  done
+}
+
+# Print the path prefix used to cache the download of the URL at $1.
+cache_path() {
+  echo "${STATE_DIR}/cache/$(echo "$1" | sha256sum | cut -c1-32)"
+}
+
+# Save the file at $2 and the last response's ETag and Last-Modified headers
+# as the cache at prefix $1.
+save_cache() {
+  mkdir -p "${STATE_DIR}/cache"
+  cp "$2" "${1}.body.tmp"
+  mv "${1}.body.tmp" "${1}.body"
+  printf '%s' "$fetag" >"${1}.etag"
+  printf '%s' "$flastmod" >"${1}.lastmod"
+}
+
+# Check whether the cache at prefix $3 can be used for the URL at $1 with
+# source options $2 after it couldn't be downloaded, printing a warning if so.
+use_stale_cache() {
+  [ -f "${3}.body" ] || return 1
+  max=$(source_opt "$2" max-staleness "$MAX_STALENESS")
+  age=$(($(date +%s) - $(stat -c %Y "${3}.body")))
+  if [ "$age" -gt "$max" ]; then
+    echo "Cached copy of ${1} is too old to use" >&2
+    return 1
+  fi
+  cached=$(date -d "@$(stat -c %Y "${3}.body")" --rfc-3339=seconds)
+  echo "Using cached copy of ${1} from ${cached}" >&2
+}
+
+# Transfer the RPZ zone described by the axfr:// URL at $1 using dig and write
+# it to stdout. $2 contains source options.
+fetch_axfr() {
+  server=${1#axfr://}
+  zone=${server#*/}
+  server=${server%%/*}
+  port=53
+  case "$server" in
+    \[*\]:*) port=${server##*:}; server=${server%:*} ;;
+    *:*:*) ;;
+    *:*) port=${server##*:}; server=${server%:*} ;;
+  esac
+  server=${server#[}
+  server=${server%]}
+  keyfile=$(source_opt "$2" tsig-file)
+  axfr=$(mktemp "${tmpdir}/axfr.XXXXXX")
+  st=0
+  fetch_timeout "$2" $(socks_wrap) dig +tcp +timeout="$CONNECT_TIMEOUT" \
+    @"$server" -p "$port" ${keyfile:+-k "$keyfile"} "$zone" AXFR \
+    +noall +answer +nocomments >"$axfr" || st=$?
+  # dig also exits with 0 when the server refuses the transfer, but a complete
+  # transfer always includes the zone's SOA record.
+  if [ "$st" -ne 0 ] || grep -q '^; Transfer failed' "$axfr" || \
+      ! grep -q '[[:space:]]SOA[[:space:]]' "$axfr"; then
+    echo "Zone transfer of ${zone} from ${server} failed" >&2
+    return 1
+  fi
+  echo "\$ORIGIN ${zone%.}."
+  cat "$axfr"
+}
+
+# Clone or update the git repository described by the git+ URL at $1 and print
+# the path of the requested file or directory within the checkout. $2 contains
+# source options. Each repository is only updated once per run so that all
+# sources using it see the same commit.
+fetch_git() {
+  repo=${1#git+}
+  repo=${repo%%#*}
+  ref=$(source_opt "$2" ref HEAD)
+  checkout="${STATE_DIR}/git/$(echo "${repo}@${ref}" |
+    sed -e 's/[^-_.a-zA-Z0-9]/_/g')"
+  if ! grep -qxF "$checkout" "${tmpdir}/git-updated" 2>/dev/null; then
+    if [ ! -d "${checkout}/.git" ]; then
+      mkdir -p "${STATE_DIR}/git"
+      git init --quiet "$checkout"
+    fi
+    fetch_timeout "$2" git ${PROXY:+-c http.proxy="$PROXY"} -C "$checkout" \
+      fetch --quiet --depth 1 "$repo" "$ref" || return 1
+    git -C "$checkout" reset --quiet --hard FETCH_HEAD || return 1
+    echo "$checkout" >>"${tmpdir}/git-updated"
+  fi
+  case "$1" in
+    *#*) echo "${checkout}/${1#*#}" ;;
+    *) echo "$checkout" ;;
+  esac
+}
+
+# Return success if the data on stdin starts with an HTML page.
+html_page() {
+  head -c 1024 | tr -d ' \t\r\n' | \
+    grep -qi '^\(<!doctypehtml\|<html\|<head\|<body\)'
+}
+
+# Fetch the URL at $1 and write its decompressed contents to stdout. Local
+# paths and file:// URLs are also accepted. The files in local directories are
+# concatenated in sorted order. $2 contains source options.
+fetch() {
+  case "$1" in
+    -) decompress <&3; return ;;
+    axfr://*) fetch_axfr "$1" "$2"; return ;;
+    tlds:*) echo "${1#tlds:}" | tr , '\n'; return ;;
+    canaries:) for z in $CANARY_ZONES; do echo "$z"; done; return ;;
+    git+*) lpath=$(fetch_git "$1" "$2") || return 1 ;;
+    file://*) lpath=${1#file://} ;;
+    /*|./*|../*) lpath=$1 ;;
+    *)
+      # Download to a file first so that failures can be detected. The last
+      # copy is cached so it needn't be downloaded again if it's unchanged.
+      dl=$(mktemp "${tmpdir}/download.XXXXXX")
+      cache=$(cache_path "${cachekey:-$1}")
+      wgetrc=$(source_wgetrc "$2")
+      if [ -f "${cache}.body" ]; then
+        [ -s "${cache}.etag" ] && wgetrc="${wgetrc}
+header = If-None-Match: $(cat "${cache}.etag")"
+        [ -s "${cache}.lastmod" ] && wgetrc="${wgetrc}
+header = If-Modified-Since: $(cat "${cache}.lastmod")"
+      fi
+      if ! fetch_wget "$2" "$dl" --compression=auto "$1"; then
+        rm -f "$dl"
+        [ -z "$nostale" ] || return 1
+        use_stale_cache "$1" "$2" "$cache" || return 1
+        decompress <"${cache}.body"
+        return
+      fi
+      # Error pages (e.g. from captive portals) can also be served with other
+      # content types. They shouldn't replace the cached copy.
+      if [ "$fcode" != 304 ] && decompress <"$dl" 2>/dev/null | html_page; then
+        fctype=text/html
+      fi
+      case "$fctype" in
+        text/html*)
+          echo "${1} returned an HTML page" >&2
+          rm -f "$dl"
+          [ -z "$nostale" ] || return 1
+          use_stale_cache "$1" "$2" "$cache" || return 1
+          decompress <"${cache}.body"
+          return
+          ;;
+      esac
+      if [ "$fcode" = 304 ]; then
+        # Record that the cached copy is still current.
+        touch "${cache}.body"
+        cp "${cache}.body" "$dl"
+      else
+        # Use a subshell so the globals set by fetch_wget are preserved.
+        if ! (verify_download "$1" "$2" "$dl"); then
+          rm -f "$dl"
+          return 1
+        fi
+        save_cache "$cache" "$dl"
+      fi
+      st=0
+      decompress <"$dl" || st=$?
+      rm -f "$dl"
+      return "$st"
+      ;;
+  esac
+  if [ -d "$lpath" ]; then
+    for lfile in "$lpath"/*; do
+      if [ -f "$lfile" ]; then
+        decompress_file "$lfile" || return 1
+      fi
+    done
+  else
+    (verify_download "$1" "$2" "$lpath") || return 1
+    decompress <"$lpath"
+  fi
+}
+
+# Print the source options in $1 without the options named by the following
+# arguments.
+without_opts() {
+  wo=$1
+  shift
+  for o in $wo; do
+    for k in "$@"; do
+      case "$o" in "${k}="*) continue 2 ;; esac
+    done
+    printf '%s ' "$o"
+  done
+}
+
+# Check the detached minisign or PGP signature of the file at $3 downloaded
+# from the URL at $1 if required by the source options in $2.
+verify_signature() {
+  pubkey=$(source_opt "$2" minisign-key)
+  keyring=$(source_opt "$2" pgp-keyring)
+  if [ -n "$pubkey" ]; then
+    sigurl=$(source_opt "$2" sig-url "${1}.minisig")
+  elif [ -n "$keyring" ]; then
+    sigurl=$(source_opt "$2" sig-url "${1}.sig")
+  else
+    return 0
+  fi
+  sig=$(mktemp "${tmpdir}/sig.XXXXXX")
+  # Fetch the raw signature rather than letting fetch decompress it.
+  sigopts=$(without_opts "$2" sha256 sha256-url minisign-key pgp-keyring \
+    sig-url)
+  case "$sigurl" in
+    http://*|https://*|ftp://*)
+      wgetrc=$(source_wgetrc "$sigopts")
+      fetch_wget "$sigopts" "$sig" "$sigurl"
+      ;;
+    *) cp "${sigurl#file://}" "$sig" ;;
+  esac
+  if [ "$?" -ne 0 ]; then
+    echo "Failed to fetch signature for ${1}" >&2
+    return 1
+  fi
+  if [ -n "$pubkey" ]; then
+    err=$(minisign -V -q -p "$pubkey" -m "$3" -x "$sig" 2>&1) && return 0
+  else
+    err=$(gpgv --keyring "$keyring" "$sig" "$3" 2>&1) && return 0
+  fi
+  echo "$err" >&2
+  echo "Bad signature for ${1}" >&2
+  return 1
+}
+
+# Check the file at $3 downloaded from the URL at $1 against the SHA-256
+# checksum and signature supplied by the source options in $2, if any. A
+# sha256-url file can either contain just the checksum or lines in sha256sum's
+# format, in which case the line naming the URL's last component is used.
+verify_download() {
+  verify_signature "$@" || return 1
+  want=$(source_opt "$2" sha256)
+  sumurl=$(source_opt "$2" sha256-url)
+  if [ -n "$sumurl" ]; then
+    sums=$(mktemp "${tmpdir}/sums.XXXXXX")
+    if ! fetch "$sumurl" "$(without_opts "$2" sha256 sha256-url)" >"$sums"; then
+      echo "Failed to fetch checksum for ${1}" >&2
+      return 1
+    fi
+    want=$(awk -v name="${1##*/}" '
+      NF == 1 && NR == 1 { only = $1 }
+      NF == 2 && ($2 == name || $2 == "*" name) { print $1; found = 1; exit }
+      END { if (!found) print only }' "$sums")
+  fi
+  if [ -z "$want" ]; then
+    [ -z "$sumurl" ] && return 0
+    echo "No checksum for ${1} in ${sumurl}" >&2
+    return 1
+  fi
+  got=$(sha256sum <"$3" | cut -d' ' -f1)
+  if [ "$got" != "$(echo "$want" | tr A-F a-f)" ]; then
+    echo "SHA-256 checksum mismatch for ${1}" >&2
+    return 1
+  fi
+}
+
+# Fetch MISP data from the URL at $1 and write it to stdout. $2 contains source
+# options. For feed manifest.json URLs, each listed event is fetched. For
+# restSearch URLs, the instance is queried for domain-related attributes.
+fetch_misp() {
+  case "$1" in
+    */manifest.json)
+      manifest=$(mktemp "${tmpdir}/manifest.XXXXXX")
+      fetch "$1" "$2" >"$manifest" || return 1
+      uuids=$(jq -r 'keys[]' "$manifest") || return 1
+      for uuid in $uuids; do
+        fetch "${1%/manifest.json}/${uuid}.json" "$(without_opts "$2" \
+          sha256 sha256-url minisign-key pgp-keyring sig-url)" || return 1
+      done
+      ;;
+    http*/attributes/restSearch)
+      wgetrc="header = Authorization: $(cat "$(source_opt "$2" misp-key-file)")"
+      tags=$(source_opt "$2" tags)
+      dl=$(mktemp "${tmpdir}/download.XXXXXX")
+      fetch_wget "$2" "$dl" \
+        --header='Content-Type: application/json' \
+        --header='Accept: application/json' \
+        --post-data="$(jq -cn --arg tags "$tags" '{
+          returnFormat: "json",
+          type: ["domain", "hostname", "domain|ip", "url"]
+        } + (if $tags == "" then {} else {tags: ($tags | split(","))} end)')" \
+        "$1" || return 1
+      cat "$dl"
+      ;;
+    *) fetch "$1" "$2" ;;
+  esac
+}
+
+# Print each allow URL.
+allow_urls() {
+  echo "$ALLOW_URLS" | awk 'NF { print $1 }'
+}
+
+# Print each enabled deny URL preceded by its index and followed by its
+# options. CANARIES is listed first so other sources can't change how the
+# canaries are answered, and BLOCK_TLDS is listed last.
+sources() {
+  {
+    if [ -n "$CANARIES" ]; then
+      echo "canaries: action=always_nxdomain"
+    fi
+    echo "$DENY_URLS"
+    if [ -n "$BLOCK_TLDS" ]; then
+      echo "tlds:$(echo $BLOCK_TLDS | sed -e 's/^\.//' -e 's/ \.*/,/g')"
+    fi
+  } | awk 'NF && !/[ \t]enabled=(no|false|0)([ \t]|$)/ { print ++i, $0 }'
+}
+
+# Print the sources like sources, omitting ones that only audit their zones.
+enforced_sources() {
+  sources | awk '!/[ \t]action=audit([ \t]|$)/'
+}
+
+# If the file at $1 is a tar or zip archive, replace it with the concatenated
+# contents of the files within it that are selected by the include and exclude
+# globs in the options in $2. Returns 1 if the archive can't be unpacked.
+unpack_archive() {
+  if [ "$(od -An -tx1 -N4 "$1" | tr -d ' ')" = 504b0304 ]; then
+    kind=zip
+  elif [ "$(od -An -c -j257 -N5 "$1" 2>/dev/null | tr -d ' ')" = ustar ]; then
+    kind=tar
+  else
+    return 0
+  fi
+  dir="${1}.d"
+  mkdir "$dir"
+  case "$kind" in
+    zip) unzip -q -d "$dir" "$1" || return 1 ;;
+    tar) tar -x -C "$dir" -f "$1" || return 1 ;;
+  esac
+  include=$(source_opt "$2" include '*' | tr ',' ' ')
+  exclude=$(source_opt "$2" exclude | tr ',' ' ')
+  (cd "$dir" && find . -type f | sed -e 's|^\./||' | LC_ALL=C sort) | \
+    while read -r member; do
+      use=
+      set -f
+      for g in $include; do
+        case "$member" in $g) use=1 ;; esac
+      done
+      for g in $exclude; do
+        case "$member" in $g) use= ;; esac
+      done
+      set +f
+      if [ -n "$use" ]; then
+        decompress_file "${dir}/${member}" || exit 1
+      fi
+    done >"${1}.members" || return 1
+  mv "${1}.members" "$1"
+}
+
+# Print the name of the format of the file at $1 by looking at its first lines.
+detect_format() {
+  if [ "$(head -c 15 "$1")" = 'SQLite format 3' ]; then
+    echo gravity
+    return
+  fi
+  head -n 2000 "$1" | awk '
+    { sub(/\r$/, "") }
+    /^\[Adblock/ { n["abp"] += 100; next }
+    /^[ \t]*[#!;]/ || /^[ \t]*$/ { next }
+    !first++ && /^[ \t]*[[{]/ { n["json"] += 1000 }
+    /^[0-9a-fA-F:.]+[ \t]+[^ \t]/ { n["hosts"]++; next }
+    /^(address|local|server)=\// { n["dnsmasq"]++; next }
+    /^(@@)?\|\|/ { n["abp"]++; next }
+    /local-zone:/ { n["unbound"]++; next }
+    /^\$ORIGIN/ || /[ \t](CNAME|SOA|NS)[ \t]/ { n["rpz"]++; next }
+    /^[ \t]*(\*\.)?[-_.a-zA-Z0-9\200-\377]+[ \t]*(#.*)?$/ {
+      n["domains"]++
+      next
+    }
+    END {
+      best = "hosts"
+      for (f in n) if (n[f] > n[best]) best = f
+      print best
+    }'
+}
+
+# Print the value of the option named $2 from the options in $1, or $3 if the
+# option isn't present.
+source_opt() {
+  val=$3
+  for o in $1; do
+    case "$o" in
+      "${2}="*) val=${o#*=} ;;
+    esac
+  done
+  echo "$val"
+}
+
+# Report that the source at $1 with options $2 couldn't be fetched (or
+# processed as described by the verb in $3, e.g. "unpack"). Exits unless the
+# source has required=no.
+fetch_failed() {
+  case "$(source_opt "$2" required yes)" in
+    no|false|0) echo "Failed to ${3:-fetch} ${1}; skipping it" >&2 ;;
+    *) echo "Failed to ${3:-fetch} ${1}" >&2; exit 1 ;;
+  esac
+}
+
+# Rewrite the zones at the start of the lines in the file at $1 in the form
+# used in the output: lowercase, without trailing dots, and with
+# internationalized names converted to punycode by idn2. Names that aren't
+# valid per RFC 1035 (aside from allowing underscores) are dropped, and the
+# number of them is reported along with the source URL in $2.
+normalize_zones() {
+  # Internationalized names made up of allowed characters are written to a
+  # file and converted by a single idn2 process. idn2 exits at the first name
+  # it can't convert, so that name is dropped and idn2 is run again for the
+  # ones after it.
+  awk -v idn="${1}.idn" '
+    {
+      z = $0
+      rest = ""
+      if (match(z, /[ \t]/)) {
+        rest = substr(z, RSTART)
+        z = substr(z, 1, RSTART - 1)
+      }
+      z = tolower(z)
+      sub(/\.+$/, "", z)
+      if (z ~ /^[-_.a-z0-9\200-\377]+$/ && z ~ /[\200-\377]/ && !seen[z]++) {
+        print z >idn
+      }
+      print z rest
+    }' "$1" >"${1}.new"
+  mv "${1}.new" "$1"
+  : >>"${1}.idn"
+  : >"${1}.ascii"
+  noidn=
+  if [ -s "${1}.idn" ] && ! command -v idn2 >/dev/null; then
+    noidn=1
+  elif [ -s "${1}.idn" ]; then
+    while [ -s "${1}.idn" ]; do
+      st=0
+      idn2 <"${1}.idn" >"${1}.out" 2>/dev/null || st=$?
+      k=$(wc -l <"${1}.out")
+      head -n "$k" "${1}.idn" | paste -d ' ' - "${1}.out" >>"${1}.ascii"
+      [ "$st" -ne 0 ] || break
+      tail -n +"$((k + 2))" "${1}.idn" >"${1}.out"
+      mv "${1}.out" "${1}.idn"
+    done
+    rm -f "${1}.out"
+  fi
+  awk -v url="$2" -v noidn="$noidn" '
+    function valid(z,   n, labels, i) {
+      if (z == "" || length(z) > 253) return 0
+      n = split(z, labels, ".")
+      for (i = 1; i <= n; i++) {
+        if (length(labels[i]) < 1 || length(labels[i]) > 63) return 0
+        if (labels[i] !~ /^[_a-z0-9]([-_a-z0-9]*[_a-z0-9])?$/) return 0
+      }
+      return 1
+    }
+    FILENAME == ARGV[1] { ascii[$1] = $2; next }
+    {
+      z = $0
+      rest = ""
+      if (match(z, /[ \t]/)) {
+        rest = substr(z, RSTART)
+        z = substr(z, 1, RSTART - 1)
+      }
+      if (z ~ /[\200-\377]/) z = ascii[z]
+      if (!valid(z)) { rejected++; next }
+      print z rest
+    }
+    END {
+      if (noidn) {
+        print "idn2 not found; skipping internationalized names" >"/dev/stderr"
+      }
+      if (rejected) {
+        print "Rejected " rejected " invalid zones from " url >"/dev/stderr"
+      }
+    }' "${1}.ascii" "$1" >"${1}.new"
+  rm -f "${1}.idn" "${1}.ascii"
+  mv "${1}.new" "$1"
+}
+
+# Copy stdin to stdout, dropping lines with "expires=YYYY-MM-DD" annotations in
+# their comments for dates before today. A warning naming the source at $1 is
+# printed for each dropped line.
+drop_expired() {
+  awk -v url="$1" -v today="$(date +%F)" '
+    match($0, /#.*expires=[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]/) {
+      d = substr($0, RSTART + RLENGTH - 10)
+      if (d < today) {
+        e = $0
+        sub(/[ \t]*#.*/, "", e)
+        print "Ignoring " e " from " url " (expired " d ")" >"/dev/stderr"
+        next
+      }
+    }
+    { print }'
+}
+
+# Print the comma-separated categories from a "category:" annotation in the
+# comment in an awk program's current line.
+CATEGORY_AWK='
+  function categories(   c) {
+    if (!match($0, /#.*category:[-_,a-zA-Z0-9]+/)) return ""
+    c = substr($0, RSTART, RLENGTH)
+    sub(/.*category:/, "", c)
+    return c
+  }'
+
+# Read a hosts file from stdin and print its zones, each followed by a tab and
+# its categories if it has any. Entries start with one of the comma-separated
+# sink addresses in $1 and are followed by whitespace and a hostname or domain
+# name. Comments start with '#' and can apparently appear at the end of lines.
+parse_hosts() {
+  awk -v sinks="$1" "$CATEGORY_AWK"'
+    BEGIN {
+      n = split(sinks, addrs, ",")
+      for (i = 1; i <= n; i++) sink[addrs[i]] = 1
+      # Lists mapping entries to loopback addresses usually also include the
+      # standard entries for the local machine.
+      split("localhost localhost.localdomain local broadcasthost " \
+        "ip6-localhost ip6-loopback ip6-localnet ip6-mcastprefix " \
+        "ip6-allnodes ip6-allrouters ip6-allhosts", names, " ")
+      for (i in names) skip[names[i]] = 1
+    }
+    { sub(/\r$/, "") }
+    /^[ \t]*#/ { next }
+    ($1 in sink) && $2 ~ /^(\*\.)?[-_.a-zA-Z0-9\200-\377]+$/ {
+      # Wildcard entries block the parent zone, as in parse_domains.
+      sub(/^\*\./, "", $2)
+      # Skip weird entries mapping an address to itself.
+      if ($2 in sink || $2 in skip || $2 ~ /^[0-9.]+$/) next
+      c = categories()
+      print $2 (c != "" ? "\t" c : "")
+    }'
+}
+
+# Read a file listing one domain per line from stdin and print its zones like
+# parse_hosts. Comments start with '#' and can appear at the end of lines.
+# Wildcard entries like "*.example.com" are treated as blocking "example.com",
+# since zones are blocked along with their subdomains.
+parse_domains() {
+  awk "$CATEGORY_AWK"'
+    {
+      sub(/\r$/, "")
+      c = categories()
+      sub(/#.*/, "")
+    }
+    NF == 1 && $1 ~ /^(\*\.)?[-_.a-zA-Z0-9\200-\377]+$/ {
+      sub(/^\*\./, "", $1)
+      print $1 (c != "" ? "\t" c : "")
+    }'
+}
+
+# Read a dnsmasq config file from stdin and print the domains from its
+# directives that block them: "address" directives mapping domains to nothing,
+# "#", "0.0.0.0", or "::", and "local" or "server" directives without a server
+# (which dnsmasq answers locally). Other "server" directives forward queries,
+# except for ones with "#" (i.e. the standard servers), which exempt domains
+# from broader directives and are written as allow patterns to the file at $1.
+parse_dnsmasq() {
+  awk -F/ -v exceptions="$1" '
+    /^(address|local|server)=\// {
+      target = $NF
+      sub(/[ \t\r]+$/, "", target)
+      if ($1 == "address=") {
+        if (target != "" && target !~ /^(#|0\.0\.0\.0|::)$/) next
+      } else if (target == "#") {
+        for (i = 2; i < NF; i++) {
+          if ($i !~ /^[-_.a-zA-Z0-9\200-\377]+$/) continue
+          domain = $i
+          gsub(/\./, "\\.", domain)
+          print "(^|\\.)" domain "$" >exceptions
+        }
+        next
+      } else if (target != "") {
+        next
+      }
+      for (i = 2; i < NF; i++) if ($i ~ /^[-_.a-zA-Z0-9\200-\377]+$/) print $i
+    }'
+}
+
+# Read an RPZ zone file from stdin and print the domains from its QNAME policy
+# records that block them: CNAMEs to "." (NXDOMAIN), "*." (NODATA), or
+# "rpz-drop.", and A or AAAA records pointing at unspecified addresses.
+# Wildcard records are treated as blocking their parent domain, since zones
+# are blocked along with their subdomains. Passthru records are written as
+# allow patterns to the file at $1. $2 is the zone's name, used to make
+# absolute owner names relative if there's no $ORIGIN directive.
+parse_rpz() {
+  awk -v exceptions="$1" -v origin="$2" '
+    function relative(name) {
+      if (name == "@") return ""
+      if (name !~ /\.$/) return tolower(name)
+      name = tolower(substr(name, 1, length(name) - 1))
+      if (origin != "" &&
+          substr(name, length(name) - length(origin)) == "." origin) {
+        return substr(name, 1, length(name) - length(origin) - 1)
+      }
+      return name
+    }
+    BEGIN { sub(/\.$/, "", origin); origin = tolower(origin) }
+    {
+      sub(/;.*/, "")
+      sub(/[ \t\r]+$/, "")
+    }
+    inparens { if (index($0, ")")) inparens = 0; next }
+    index($0, "(") && !index($0, ")") { inparens = 1 }
+    $1 == "$ORIGIN" { origin = tolower($2); sub(/\.$/, "", origin); next }
+    /^\$/ || NF == 0 { next }
+    {
+      i = 1
+      if ($0 !~ /^[ \t]/) { owner = relative($1); i = 2 }
+      while (i < NF && ($i ~ /^[0-9]+[smhdwSMHDW]?$/ || toupper($i) == "IN"))
+        i++
+      type = toupper($i)
+      target = tolower($(i + 1))
+      name = owner
+      wildcard = sub(/^\*\./, "", name)
+      if (name == "" || name ~ /\.rpz-(ip|nsdname|nsip|client-ip)$/) next
+      if (name !~ /^[-_.a-z0-9\200-\377]+$/) next
+      if (type == "CNAME" && target == "rpz-passthru.") {
+        gsub(/\./, "\\.", name)
+        print (wildcard ? "\\." : "^") name "$" >exceptions
+      } else if ((type == "CNAME" &&
+          (target == "." || target == "*." || target == "rpz-drop.")) ||
+          (type == "A" && target == "0.0.0.0") ||
+          (type == "AAAA" && target == "::")) {
+        print name
+      }
+    }' | awk '!seen[$0]++'
+}
+
+# Print the domains blocked by the Pi-hole gravity.db SQLite database at $1:
+# the ones from its adlists and from its exact-match denylist. Its exact and
+# regex allowlist entries are written as allow patterns to the file at $2.
+# Regex denylist entries can't be expressed as zones and are skipped. Returns
+# 1 if the database can't be read.
+parse_gravity() {
+  q=$(mktemp "${tmpdir}/gravity.XXXXXX")
+  sqlite3 -readonly -batch -noheader "$1" 'SELECT domain FROM gravity;
+    SELECT domain FROM domainlist WHERE type = 1 AND enabled = 1;' >"$q" ||
+    return 1
+  grep -E '^[-_.a-zA-Z0-9]+$' "$q" | awk '!seen[$0]++'
+  sqlite3 -readonly -batch -noheader "$1" \
+    'SELECT domain FROM domainlist WHERE type = 0 AND enabled = 1;' >"$q" ||
+    return 1
+  grep -E '^[-_.a-zA-Z0-9]+$' "$q" | sed -e 's/\./\\./g' -e 's/.*/^&$/' >>"$2"
+  # Regexes with Pi-hole-specific options like ";querytype=A" are skipped.
+  sqlite3 -readonly -batch -noheader "$1" \
+    'SELECT domain FROM domainlist WHERE type = 2 AND enabled = 1;' >"$q" ||
+    return 1
+  grep -v ';' "$q" >>"$2" || true
+  rm -f "$q"
+}
+
+# Read a JSON feed from stdin and print the domains from its records like
+# parse_hosts. The records can be in a top-level array or concatenated. $1
+# contains source options. Returns 1 if the feed isn't valid JSON.
+parse_json() {
+  records=$(mktemp "${tmpdir}/json.XXXXXX")
+  jq -r --arg domain "$(source_opt "$1" domain-field domain)" \
+    --arg catfield "$(source_opt "$1" category-field)" \
+    --arg cats "$(source_opt "$1" category)" \
+    --arg conffield "$(source_opt "$1" confidence-field)" \
+    --arg minconf "$(source_opt "$1" min-confidence)" '
+    def field($name): getpath($name | split("."));
+    (if type == "array" then .[] else . end) | objects
+    | select($cats == "" or
+        ((field($catfield) | tostring) as $c
+         | $cats | split(",") | index([$c])))
+    | select($minconf == "" or
+        ((field($conffield) | tonumber? // 0) >= ($minconf | tonumber)))
+    | [(field($domain) | strings),
+       (if $catfield == "" then "" else field($catfield) // "" | tostring end)]
+    | @tsv' >"$records" || return 1
+  awk -F '\t' '{
+    d = tolower($1)
+    if (d ~ /^[-_.a-z0-9\200-\377]+$/) print d ($2 != "" ? "\t" $2 : "")
+  }' "$records"
+  rm -f "$records"
+}
+
+# Read a CSV feed with a header line from stdin and print the domains from its
+# records like parse_hosts. Lines starting with '#' are skipped. Quoted fields
+# can't contain commas. $1 contains source options.
+parse_csv() {
+  awk -F, -v domain="$(source_opt "$1" domain-field domain)" \
+    -v catfield="$(source_opt "$1" category-field)" \
+    -v cats="$(source_opt "$1" category)" \
+    -v conffield="$(source_opt "$1" confidence-field)" \
+    -v minconf="$(source_opt "$1" min-confidence)" '
+    function unquote(s) {
+      sub(/^[ \t]*"?/, "", s)
+      sub(/"?[ \t\r]*$/, "", s)
+      return s
+    }
+    BEGIN {
+      n = split(cats, list, ",")
+      for (i = 1; i <= n; i++) allowed[list[i]] = 1
+    }
+    /^#/ || NF == 0 { next }
+    !header {
+      for (i = 1; i <= NF; i++) col[unquote($i)] = i
+      if (!(domain in col)) {
+        print "Missing field " domain >"/dev/stderr"
+        exit 1
+      }
+      header = 1
+      next
+    }
+    cats != "" && !(unquote($col[catfield]) in allowed) { next }
+    minconf != "" && unquote($col[conffield]) + 0 < minconf + 0 { next }
+    {
+      d = tolower(unquote($col[domain]))
+      c = catfield != "" ? unquote($col[catfield]) : ""
+      if (d ~ /^[-_.a-z0-9\200-\377]+$/) print d (c != "" ? "\t" c : "")
+    }'
+}
+
+# Read an Unbound config file from stdin and print the names from its
+# local-zone directives that use types that block queries.
+parse_unbound() {
+  awk '
+    {
+      sub(/#.*/, "")
+      if (!match($0, /local-zone:[ \t]*"?[^" \t]+"?[ \t]+[a-z_]+/)) next
+      n = split(substr($0, RSTART, RLENGTH), f, /[ \t"]+/)
+      name = tolower(f[2])
+      sub(/\.$/, "", name)
+      if ((f[n] ~ /^(deny|refuse|static|redirect|inform_deny)$/ ||
+           f[n] ~ /^always_(refuse|nxdomain|nodata|deny|null)$/) &&
+          name ~ /^[-_.a-z0-9\200-\377]+$/) {
+        print name
+      }
+    }'
+}
+
+# Print the hostname from the URL in an awk program's variable, or an empty
+# string if the URL doesn't contain a hostname (e.g. it uses an IP address).
+URL_HOST_AWK='
+  function urlhost(u) {
+    sub(/^[a-zA-Z][-+.a-zA-Z0-9]*:\/\//, "", u)
+    sub(/[\/?#].*/, "", u)
+    sub(/.*@/, "", u)
+    sub(/:[0-9]*$/, "", u)
+    u = tolower(u)
+    if (u !~ /^[-_.a-z0-9]+$/ || u ~ /^[0-9.]+$/) return ""
+    return u
+  }'
+
+# Read an abuse.ch URLhaus export (either the plain-text URL list or the CSV
+# dump) from stdin and print the hostnames of its URLs, categorized as
+# "malware".
+parse_urlhaus() {
+  awk "$URL_HOST_AWK"'
+    /^#/ { next }
+    {
+      # Only the url field of CSV lines is used, not e.g. urlhaus_link.
+      line = $0
+      if (line ~ /^"/) {
+        if (split(line, f, /"[ \t]*,[ \t]*"/) < 3) next
+        line = f[3]
+      }
+      if (!match(line, /https?:\/\/[^" \t\r,]+/)) next
+      h = urlhost(substr(line, RSTART, RLENGTH))
+      if (h != "" && !seen[h]++) print h "\tmalware"
+    }'
+}
+
+# Read an abuse.ch ThreatFox CSV export from stdin and print the domains from
+# its domain and URL IOCs, categorized as "malware".
+parse_threatfox() {
+  awk "$URL_HOST_AWK"'
+    /^#/ { next }
+    {
+      n = split($0, f, /"[ \t]*,[ \t]*"/)
+      if (n < 4) next
+      if (f[4] != "domain" && f[4] != "url") next
+      h = urlhost(f[3])
+      if (h != "" && !seen[h]++) print h "\tmalware"
+    }'
+}
+
+# Read MISP JSON (events or restSearch responses) from stdin and print the
+# domains from its domain, hostname, domain|ip, and URL attributes. If $1 is
+# non-empty, only attributes tagged (directly or via their event) with one of
+# its comma-separated tags are used. Returns 1 if the data isn't valid JSON.
+parse_misp() {
+  attrs=$(mktemp "${tmpdir}/misp.XXXXXX")
+  jq -r --arg tags "$1" '
+    def names: [.Tag[]?.name];
+    def tagged($extra):
+      select($tags == "" or ((names + $extra) as $n |
+        [$tags | split(",")[] | . as $t
+         | $n | map(select(. == $t)) | length > 0] | any));
+    if has("Event") then
+      .Event as $e | ($e | names) as $et
+      | ($e.Attribute[]?, $e.Object[]?.Attribute[]?) | tagged($et)
+    elif has("response") then
+      (.response.Attribute? // .response)[]? | tagged([])
+    else empty end
+    | select(.type == "domain" or .type == "hostname" or
+        .type == "domain|ip" or .type == "url")
+    | [.type, .value] | @tsv' >"$attrs" || return 1
+  awk -F '\t' "$URL_HOST_AWK"'
+    {
+      if ($1 == "domain|ip") sub(/\|.*/, "", $2)
+      h = urlhost($2)
+      if (h != "" && !seen[h]++) print h
+    }' "$attrs"
+  rm -f "$attrs"
+}
+
+# Read an Adblock Plus filter list from stdin and print the domains from its
+# "||domain^" rules. Rules with modifiers that restrict them to some requests
+# (e.g. "$script" or "$third-party") are skipped since the whole domain can't
+# be blocked for them. The wildcard variants used by oisd and Hagezi
+# ("||*.domain^" and bare "*.domain" lines) are also accepted. The domains
+# from "@@" exception rules are written as allow patterns to the file at $1.
+parse_abp() {
+  awk -v exceptions="$1" '
+    /^[!\[]/ { next }
+    {
+      rule = $0
+      sub(/[ \t\r]+$/, "", rule)
+      exception = sub(/^@@/, "", rule)
+      if ((i = index(rule, "$")) > 0) {
+        n = split(substr(rule, i + 1), mods, ",")
+        for (j = 1; j <= n; j++) {
+          if (mods[j] !~ /^(important|all|document|doc)$/) next
+        }
+        rule = substr(rule, 1, i - 1)
+      }
+      if (rule !~ /^\|\|(\*\.)?[-_.a-zA-Z0-9\200-\377]+\^\|?$/ &&
+          rule !~ /^\*\.[-_.a-zA-Z0-9\200-\377]+\^?$/) next
+      domain = rule
+      sub(/^(\|\|)?(\*\.)?/, "", domain)
+      sub(/\^\|?$/, "", domain)
+      if (exception) {
+        gsub(/\./, "\\.", domain)
+        print "(^|\\.)" domain "$" >exceptions
+      } else {
+        print domain
+      }
+    }'
+}
+
+# Deny source options.
+DENY_OPTIONS="
+  format sink categories origin tsig-file ref
+  domain-field category-field category confidence-field min-confidence
+  tags misp-key-file include exclude
+  action required enabled
+  timeout retries max-staleness
+  auth-file auth-env token-file token-env header user-agent
+  sha256 sha256-url minisign-key pgp-keyring sig-url
+  max-size ca-file pin tls-min limit-rate mirror
+  clients schedule sinkhole allow weight priority candidates public-suffixes
+"
+DENY_FORMATS="
+  auto hosts domains dnsmasq rpz abp gravity json csv unbound
+  urlhaus threatfox misp
+"
+
+# Print an error about the source at $1 for validate_config.
+invalid() {
+  echo "${1}: ${2}" >&2
+  errors=$((errors + 1))
+}
+
+# Check that the source URL at $1 is well-formed and that local paths exist.
+validate_url() {
+  case "$1" in
+    -) ;;
+    axfr://?*/?*|git+?*|http://?*|https://?*|ftp://?*|tlds:?*|canaries:) ;;
+    file://*|/*|./*|../*)
+      [ -e "${1#file://}" ] || invalid "$1" "no such file or directory"
+      ;;
+    *) invalid "$1" "unsupported URL" ;;
+  esac
+}
+
+# Check the option value $3 of the source at $1 for the option named $2
+# against the space-separated allowed values in $4.
+validate_opt() {
+  for allowed in $4; do
+    [ "$allowed" != "$3" ] || return 0
+  done
+  invalid "$1" "invalid ${2} '${3}'"
+}
+
+# Check that the regular expressions in the pattern list at $1 compile if it's
+# a local file.
+validate_patterns() {
+  case "$1" in
+    file://*|/*|./*|../*) [ -f "${1#file://}" ] || return 0 ;;
+    *) return 0 ;;
+  esac
+  # grep exits with 1 when valid patterns don't match the empty input.
+  if ! err=$(sed -e 's/#.*//' -e 's/^\s*//' -e 's/\s*$//' \
+      -e '/^\*\./d' -e '/^$/d' "${1#file://}" |
+      grep -E -f - /dev/null 2>&1 >/dev/null) && [ -n "$err" ]; then
+    invalid "$1" "${err#grep: }"
+  fi
+}
+
+# Check the deny and allow sources without fetching them, printing problems
+# to stderr. Returns 1 if there were any.
+validate_config() {
+  errors=0
+  while read -r n url opts; do
+    validate_url "$url"
+    for o in $opts; do
+      case "$o" in
+        allow=*) validate_url "${o#*=}"; validate_patterns "${o#*=}" ;;
+        *=*) validate_opt "$url" option "${o%%=*}" "$DENY_OPTIONS" ;;
+        *) invalid "$url" "malformed option '${o}'" ;;
+      esac
+    done
+    validate_opt "$url" format "$(source_opt "$opts" format auto)" \
+      "$DENY_FORMATS"
+    validate_opt "$url" action "$(source_opt "$opts" action "$ACTION")" \
+      "$ACTIONS"
+    validate_opt "$url" required "$(source_opt "$opts" required yes)" \
+      "yes no true false 1 0"
+    spec=$(source_opt "$opts" schedule)
+    if [ -n "$spec" ] && ! valid_schedule "$spec"; then
+      invalid "$url" "invalid schedule '${spec}'"
+    fi
+  done <<EOF
+$(echo "$DENY_URLS" | awk 'NF { print ++i, $0 }')
+EOF
+  while read -r url opts; do
+    [ -n "$url" ] || continue
+    validate_url "$url"
+    f=$(source_opt "$opts" format regexp)
+    validate_opt "$url" format "$f" "regexp domains"
+    for o in $opts; do
+      validate_opt "$url" option "${o%%=*}" "format required"
+    done
+    if [ "$f" = regexp ]; then
+      validate_patterns "$url"
+    fi
+  done <<EOF
+$(echo "$ALLOW_URLS" | awk 'NF')
+EOF
+  while read -r url opts; do
+    [ -n "$url" ] || continue
+    validate_url "$url"
+    for o in $opts; do
+      validate_opt "$url" option "${o%%=*}" "required"
+    done
+    validate_patterns "$url"
+  done <<EOF
+$(echo "$DENY_PATTERN_URLS" | awk 'NF')
 EOF
+  [ "$errors" -eq 0 ]
+}
+
+# Return success if the schedule at $1 is active at the time at $2, given as
+# the output of "date '+%w %H:%M'".
+schedule_active() {
+  echo "$2" | awk -v spec="$1" '
+    function minutes(t,   hm) { split(t, hm, ":"); return hm[1] * 60 + hm[2] }
+    function dayno(d) { return (index("sunmontuewedthufrisat", d) - 1) / 3 }
+    {
+      days = "sun-sat"
+      times = spec
+      if (i = index(spec, "@")) {
+        days = substr(spec, 1, i - 1)
+        times = substr(spec, i + 1)
+      }
+      split(times, t, "-")
+      start = minutes(t[1])
+      end = minutes(t[2])
+      n = split(days, d, ",")
+      for (i = 1; i <= n; i++) {
+        if (split(d[i], r, "-") == 1) r[2] = r[1]
+        for (j = dayno(r[1]); ; j = (j + 1) % 7) {
+          on[j] = 1
+          if (j == dayno(r[2])) break
+        }
+      }
+      today = $1 + 0
+      now = minutes($2)
+      if (start < end) active = (today in on) && now >= start && now < end
+      else active = ((today in on) && now >= start) || \
+        (((today + 6) % 7) in on && now < end)
+      exit !active
+    }'
+}
+
+# Add the zones of the schedules in "${STATE_DIR}/schedules" that are active
+# now to Unbound, and remove ones whose schedules have ended (or whose zones
+# have changed). Each line of that file is "N SCHEDULE MODE", where N is a
+# source's index or "c-CATEGORY" for CATEGORY_SCHEDULES.
+# "${STATE_DIR}/schedule.N" contains the schedule's "ZONE TYPE" lines, and
+# "${STATE_DIR}/schedule.N.active" contains the ones that are currently loaded.
+# Zones with MODE "tags" have client tags that can't be set with
+# unbound-control, so they're made transparent rather than being removed.
+apply_schedules() {
+  [ -f "${STATE_DIR}/schedules" ] || return 0
+  now=$(date '+%w %H:%M')
+  for f in "${STATE_DIR}"/schedule.*.active; do
+    [ -f "$f" ] || continue
+    n=${f%.active}
+    n=${n##*.}
+    read -r spec mode <<EOF
+$(awk -v n="$n" '$1 == n { print $2, $3 }' "${STATE_DIR}/schedules")
+EOF
+    if [ -n "$spec" ] && schedule_active "$spec" "$now" && \
+        cmp -s "$f" "${STATE_DIR}/schedule.${n}"; then
+      continue
+    fi
+    if [ "$mode" = tags ]; then
+      awk '{ print $1, "transparent" }' "$f" | \
+        unbound-control local_zones >/dev/null
+    else
+      cut -d' ' -f1 "$f" | unbound-control local_zones_remove >/dev/null
+    fi
+    rm "$f"
+  done
+  while read -r n spec mode; do
+    [ ! -f "${STATE_DIR}/schedule.${n}.active" ] || continue
+    schedule_active "$spec" "$now" || continue
+    unbound-control local_zones <"${STATE_DIR}/schedule.${n}" >/dev/null
+    cp "${STATE_DIR}/schedule.${n}" "${STATE_DIR}/schedule.${n}.active"
+  done <"${STATE_DIR}/schedules"
+}
+
+if [ -n "$validate" ]; then
+  if validate_config; then
+    echo "Configuration is valid"
+    exit 0
+  fi
+  exit 1
+fi
+
+if [ -n "$schedule" ]; then
+  apply_schedules
+  exit 0
+fi
+
+# Fetch the source at $2 with options $3 into "${4}.${1}". If the fetch fails
+# or the source is too large, "${4}.${1}.failed" is created.
+fetch_source() {
+  fetcher=fetch
+  [ "$(source_opt "$3" format)" = misp ] && fetcher=fetch_misp
+  max=$(source_opt "$3" max-size "$MAX_SOURCE_SIZE")
+  # Stop writing files (including downloads and decompressed data) once they
+  # exceed the limit. ulimit uses 512-byte blocks.
+  limit=unlimited
+  [ "$max" -gt 0 ] && limit=$((max / 512 + 1))
+  # Try the mirrors in order. The cache is shared by all of the URLs, and only
+  # used as a fallback after the last one fails.
+  cachekey=$2
+  mirrors=$(for o in $3; do case "$o" in mirror=*) echo "${o#*=}" ;; esac; done)
+  last=$(echo "$2" $mirrors | awk '{print $NF}')
+  for u in "$2" $mirrors; do
+    nostale=1
+    if [ "$u" = "$last" ]; then
+      nostale=
+    fi
+    st=0
+    (ulimit -f "$limit" && "$fetcher" "$u" "$3" >"${4}.${1}") || st=$?
+    if [ "$st" -eq 0 ]; then
+      break
+    elif [ -n "$nostale" ]; then
+      echo "Failed to fetch ${u}; trying a mirror" >&2
+    fi
+  done
+  cachekey=
+  if [ "$max" -gt 0 ] && [ "$(stat -c %s "${4}.${1}")" -gt "$max" ]; then
+    echo "${2} is larger than ${max} bytes" >&2
+    st=1
+  fi
+  # Catch error pages (e.g. from captive portals) in other kinds of sources.
+  if [ "$st" -eq 0 ] && html_page <"${4}.${1}"; then
+    echo "${2} contains an HTML page" >&2
+    st=1
+  fi
+  if [ "$st" -ne 0 ]; then
+    : >"${4}.${1}.failed"
+  fi
+}
+
+# Fetch the sources listed as "N URL OPTIONS" lines in the file at $1 into
+# files with the prefix $2 (see fetch_source), running up to $FETCH_JOBS
+# fetches in parallel. Each download from a host that was already used in
+# this run is delayed by a further $STAGGER seconds.
+fetch_all() {
+  jobs=0
+  while read -r n url opts; do
+    case "$url" in
+      # Checkouts may be shared by multiple sources, so update them serially.
+      git+*) fetch_source "$n" "$url" "$opts" "$2"; continue ;;
+      http://*|https://*|ftp://*)
+        host=${url#*://}
+        host=${host%%[/:?#]*}
+        delay=$(echo "$fetched_hosts" | grep -cxF "$host" || true)
+        delay=$((delay * STAGGER))
+        fetched_hosts="${fetched_hosts}
+${host}"
+        ;;
+      *) delay=0 ;;
+    esac
+    { sleep "$delay"; fetch_source "$n" "$url" "$opts" "$2"; } &
+    jobs=$((jobs + 1))
+    if [ "$jobs" -ge "$FETCH_JOBS" ]; then
+      wait
+      jobs=0
+    fi
+  done <"$1"
+  wait
+}
+
+# Avoid fetching at the same time as other hosts running from cron.
+if [ "$JITTER" -gt 0 ]; then
+  sleep $(($(od -An -N2 -tu2 /dev/urandom) % (JITTER + 1)))
+fi
+fetched_hosts=
+exec 3<&0
+echo "$ALLOW_URLS" | awk 'NF { print ++i, $0 }' >"${tmpdir}/allow-sources"
+echo "$DENY_PATTERN_URLS" | awk 'NF { print ++i, $0 }' \
+  >"${tmpdir}/deny-pattern-sources"
+sources >"${tmpdir}/sources"
+# Per-source allow lists are numbered "N.M" for the Mth list of source N.
+while read -r n url opts; do
+  for o in $opts; do
+    case "$o" in
+      allow=*) echo "$n ${o#*=}" ;;
+    esac
+  done
+done <"${tmpdir}/sources" | awk '{ print $1 "." ++i[$1], $2 }' \
+  >"${tmpdir}/source-allow-sources"
+fetch_all "${tmpdir}/allow-sources" "${tmpdir}/allow-raw"
+fetch_all "${tmpdir}/source-allow-sources" "${tmpdir}/source-allow-raw"
+fetch_all "${tmpdir}/deny-pattern-sources" "${tmpdir}/deny-pattern-raw"
+fetch_all "${tmpdir}/sources" "${tmpdir}/raw"
+if [ -n "$PSL_URL" ]; then
+  fetch_source 1 "$PSL_URL" "" "${tmpdir}/psl"
+  if [ -e "${tmpdir}/psl.1.failed" ]; then
+    fetch_failed "$PSL_URL" ""
+  fi
+fi
+
+# Concatenate the allow lists into "${tmpdir}/allow", so later lists can add
+# site-specific patterns to shared ones. We can safely drop everything after
+# '#' since it isn't allowed in domain names. Domains from format=domains
+# lists are written to "${tmpdir}/allow-domains" as "DOMAIN exact" or
+# "DOMAIN subtree" lines.
+allow="${tmpdir}/allow"
+allowdomains="${tmpdir}/allow-domains"
+: >"$allow"
+: >"$allowdomains"
+while read -r n url opts; do
+  if [ -e "${tmpdir}/allow-raw.${n}.failed" ]; then
+    fetch_failed "$url" "$opts"
+    continue
+  fi
+  f=$(source_opt "$opts" format regexp)
+  case "$f" in
+    regexp)
+      drop_expired "$url" <"${tmpdir}/allow-raw.${n}" | \
+        sed -e 's/#.*//' -e 's/^\s*//' -e 's/\s*$//' | \
+        awk -v domains="$allowdomains" '
+          /^\*\.[-_a-zA-Z0-9.\200-\377]+$/ {
+            print tolower(substr($0, 3)) " subtree" >>domains
+            next
+          }
+          /./ { print }' >>"$allow"
+      ;;
+    domains)
+      drop_expired "$url" <"${tmpdir}/allow-raw.${n}" | awk '{
+        sub(/\r$/, "")
+        sub(/#.*/, "")
+        if (NF != 1) next
+        d = tolower($1)
+        if (sub(/^\*?\./, "", d)) print d " subtree"
+        else print d " exact"
+      }' >>"$allowdomains"
+      ;;
+    *) echo "Unknown allow format '${f}' for ${url}" >&2; exit 1 ;;
+  esac
+done <"${tmpdir}/allow-sources"
+normalize_zones "$allowdomains" "allow lists"
 
-# Add the zones from each file. Entries start with "0.0.0.0" and are followed by
-# whitespace and a hostname or domain name. Comments start with '#' and can
-# apparently appear at the end of lines.
-for url in $DENY_URLS; do
-  echo >>"$out"
-  echo "# ${url}" >>"$out"
-  # The first grep skips weird entries mapping 0.0.0.0 to itself.
-  wget --quiet -O- "$url" | \
-    sed -nre 's/^0\.0\.0\.0\s+([-_.a-zA-Z0-9]+)(\s.*|$)/\1/p' | \
-    grep -v '^0\.0\.0\.0$' | \
-    grep -v --extended-regexp -f "${allow}" | \
-    awk '{print "local-zone: \""$1"\" refuse"}' >>"$out"
+# Concatenate the deny patterns into "${tmpdir}/deny-patterns" in the same way.
+denypatterns="${tmpdir}/deny-patterns"
+: >"$denypatterns"
+while read -r n url opts; do
+  if [ -e "${tmpdir}/deny-pattern-raw.${n}.failed" ]; then
+    fetch_failed "$url" "$opts"
+    continue
+  fi
+  sed -e 's/#.*//' -e 's/^\s*//' -e 's/\s*$//' -e '/^$/d' \
+    "${tmpdir}/deny-pattern-raw.${n}" >>"$denypatterns"
+done <"${tmpdir}/deny-pattern-sources"
+# Keywords are added as patterns matching them literally.
+for k in $DENY_KEYWORDS; do
+  echo "$k" | sed -e 's/[].[^$*+?(){}|\\]/\\&/g' >>"$denypatterns"
+done
+
+# Extract the entries from each fetched file in "${tmpdir}/raw.N" into
+# "${tmpdir}/parsed.N". Each line contains a zone, optionally followed by a tab
+# and a comma-separated list of categories.
+while read -r n url opts; do
+  raw="${tmpdir}/raw.${n}"
+  parsed="${tmpdir}/parsed.${n}"
+  case "$url" in
+    axfr://*) f=$(source_opt "$opts" format rpz) ;;
+    *) f=$(source_opt "$opts" format auto) ;;
+  esac
+  action=$(source_opt "$opts" action "$ACTION")
+  if ! echo " ${ACTIONS} " | grep -q " ${action} "; then
+    echo "Unknown action '${action}' for ${url}" >&2
+    exit 1
+  fi
+  if [ "$action" = redirect ] && \
+      [ -z "$(source_opt "$opts" sinkhole "$SINKHOLE")" ]; then
+    echo "No sinkhole addresses for ${url}" >&2
+    exit 1
+  fi
+  spec=$(source_opt "$opts" schedule)
+  if [ -n "$spec" ]; then
+    if ! valid_schedule "$spec"; then
+      echo "Invalid schedule '${spec}' for ${url}" >&2
+      exit 1
+    elif [ "$action" = redirect ]; then
+      echo "Schedule for ${url} can't be used with redirect" >&2
+      exit 1
+    elif ! echo "$targets" | grep -q '^unbound '; then
+      echo "Schedule for ${url} requires Unbound output" >&2
+      exit 1
+    fi
+  fi
+  if [ -e "${raw}.failed" ]; then
+    fetch_failed "$url" "$opts"
+    : >"$raw"
+  fi
+  # Record the size and hash of the download for the manifest.
+  if echo "$targets" | grep -q '^manifest '; then
+    echo "$(wc -c <"$raw") $(sha256sum <"$raw" | cut -d' ' -f1)" \
+      >"${tmpdir}/fetched.${n}"
+  fi
+  if [ "$f" != misp ] && ! unpack_archive "$raw" "$opts"; then
+    fetch_failed "$url" "$opts" unpack
+    : >"$raw"
+  fi
+  case "$url" in
+    file://*|/*|./*|../*)
+      drop_expired "$url" <"$raw" >"${raw}.new"
+      mv "${raw}.new" "$raw"
+      ;;
+  esac
+  [ "$f" = auto ] && f=$(detect_format "$raw")
+  # Parsers that can fail return non-zero, and the source is then handled like
+  # one that couldn't be fetched.
+  st=0
+  case "$f" in
+    hosts)
+      parse_hosts "$(source_opt "$opts" sink 0.0.0.0)" <"$raw" >"$parsed"
+      ;;
+    domains) parse_domains <"$raw" >"$parsed" ;;
+    dnsmasq) parse_dnsmasq "${tmpdir}/exceptions.${n}" <"$raw" >"$parsed" ;;
+    rpz)
+      parse_rpz "${tmpdir}/exceptions.${n}" "$(source_opt "$opts" origin)" \
+        <"$raw" >"$parsed"
+      ;;
+    abp) parse_abp "${tmpdir}/exceptions.${n}" <"$raw" >"$parsed" ;;
+    json) parse_json "$opts" <"$raw" >"$parsed" || st=$? ;;
+    csv) parse_csv "$opts" <"$raw" >"$parsed" ;;
+    unbound) parse_unbound <"$raw" >"$parsed" ;;
+    urlhaus) parse_urlhaus <"$raw" >"$parsed" ;;
+    threatfox) parse_threatfox <"$raw" >"$parsed" ;;
+    misp)
+      parse_misp "$(source_opt "$opts" tags)" <"$raw" >"$parsed" || st=$?
+      ;;
+    gravity)
+      parse_gravity "$raw" "${tmpdir}/exceptions.${n}" >"$parsed" || st=$?
+      ;;
+    *) echo "Unknown format '${f}' for ${url}" >&2; exit 1 ;;
+  esac
+  if [ "$st" -ne 0 ]; then
+    fetch_failed "$url" "$opts" parse
+    : >"$parsed"
+    rm -f "${tmpdir}/exceptions.${n}"
+  fi
+  normalize_zones "$parsed" "$url"
+  cats=$(source_opt "$opts" categories)
+  if [ -n "$cats" ]; then
+    awk -v cats="$cats" 'NF == 1 { $0 = $0 "\t" cats } { print }' "$parsed" \
+      >"${parsed}.new"
+    mv "${parsed}.new" "$parsed"
+  fi
+  if [ -n "$CATEGORIES" ]; then
+    awk -F '\t' -v want="$CATEGORIES" '
+      BEGIN {
+        n = split(want, w, ",")
+        for (i = 1; i <= n; i++) wanted[w[i]] = 1
+      }
+      NF == 1 { if ("uncategorized" in wanted) print; next }
+      {
+        n = split($2, c, ",")
+        for (i = 1; i <= n; i++) if (c[i] in wanted) { print; next }
+      }' "$parsed" >"${parsed}.new"
+    mv "${parsed}.new" "$parsed"
+  fi
+done <"${tmpdir}/sources"
+
+# Exceptions from sources apply to all of them.
+cat "${tmpdir}"/exceptions.* >>"$allow" 2>/dev/null || true
+
+# Entries matched by allow patterns (including the source's own ones) are
+# written to "${tmpdir}/allowed.N" and the rest to "${tmpdir}/zones.N".
+# The patterns are only matched against the zones, not their categories.
+while read -r n url opts; do
+  cp "$allow" "${tmpdir}/source-allow"
+  while read -r m aurl; do
+    [ "${m%.*}" = "$n" ] || continue
+    if [ -e "${tmpdir}/source-allow-raw.${m}.failed" ]; then
+      fetch_failed "$aurl" "$opts"
+      continue
+    fi
+    drop_expired "$aurl" <"${tmpdir}/source-allow-raw.${m}" | \
+      sed -e 's/#.*//' -e 's/^\s*//' -e 's/\s*$//' -e '/^$/d' \
+      >>"${tmpdir}/source-allow"
+  done <"${tmpdir}/source-allow-sources"
+  cut -f1 "${tmpdir}/parsed.${n}" | \
+    grep -n --extended-regexp -f "${tmpdir}/source-allow" | \
+    cut -d: -f1 >"${tmpdir}/matched" || true
+  awk -v allowed="${tmpdir}/allowed.${n}" '
+    function domain_allowed(d) {
+      if (d in exact || d in subtree) return 1
+      while (sub(/^[^.]*\./, "", d)) if (d in subtree) return 1
+      return 0
+    }
+    FILENAME == ARGV[1] {
+      if ($2 == "subtree") subtree[$1] = 1
+      else exact[$1] = 1
+      next
+    }
+    FILENAME == ARGV[2] { matched[$1] = 1; next }
+    FNR in matched || domain_allowed($1) { print >allowed; next }
+    { print }' "$allowdomains" "${tmpdir}/matched" "${tmpdir}/parsed.${n}" \
+    >"${tmpdir}/zones.${n}"
+  touch "${tmpdir}/allowed.${n}"
+done <"${tmpdir}/sources"
+
+# Print the allow patterns that just match a literal domain, the domains from
+# format=domains allow lists, SAFE_ZONES, and the CNAME targets found for
+# UNCLOAK_CNAMES, followed by "exact" if only the domain itself is allowed or
+# "subtree" if its subdomains are also allowed.
+literal_allows() {
+  sed -nre 's/^\^(([-_a-zA-Z0-9]|\\\.)+)\$$/\1 exact/p' \
+    -e 's/^[(]\^[|]\\\.[)](([-_a-zA-Z0-9]|\\\.)+)\$$/\1 subtree/p' \
+    "$allow" | sed -e 's/\\\././g'
+  cat "$allowdomains"
+  for z in $SAFE_ZONES; do
+    echo "$z subtree"
+  done
+  if [ -f "${tmpdir}/cname-targets" ]; then
+    sed -e 's/$/ exact/' "${tmpdir}/cname-targets"
+  fi
+}
+
+# Allow the CNAME targets of literally allowed domains, so allowed sites aren't
+# broken by blocked CDN names. Zones that are targets are dropped, and targets
+# within blocked zones are allowed through literal_allows.
+if [ -n "$UNCLOAK_CNAMES" ]; then
+  literal_allows | while read -r d kind; do
+    dig +short +tries=1 +timeout="$CONNECT_TIMEOUT" "$d" A | \
+      sed -n -e 's/\.$//p'
+  done | tr A-Z a-z | sort -u >"${tmpdir}/cname-targets.new"
+  mv "${tmpdir}/cname-targets.new" "${tmpdir}/cname-targets"
+  while read -r n url opts; do
+    awk -F '\t' -v allowed="${tmpdir}/allowed.${n}" -v url="$url" '
+      FILENAME == ARGV[1] { target[$1] = 1; next }
+      $1 in target {
+        print "Allowing " $1 " from " url " for an allowed CNAME" >"/dev/stderr"
+        print >>allowed
+        next
+      }
+      { print }' "${tmpdir}/cname-targets" "${tmpdir}/zones.${n}" \
+      >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Move zones within SAFE_ZONES to the allowed entries.
+while read -r n url opts; do
+  for z in $SAFE_ZONES; do echo "$z"; done | \
+    awk -F '\t' -v allowed="${tmpdir}/allowed.${n}" -v url="$url" '
+      function parent_safe(d) {
+        while (sub(/^[^.]*\./, "", d)) if (d in safe) return 1
+        return 0
+      }
+      FILENAME == "-" { safe[$1] = 1; next }
+      $1 in safe || parent_safe($1) {
+        print "Not blocking safe zone " $1 " from " url >"/dev/stderr"
+        print >>allowed
+        next
+      }
+      { print }' - "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+  mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources"
+
+# Only keep the entries from candidate sources that match deny patterns.
+while read -r n url opts; do
+  case "$(source_opt "$opts" candidates no)" in
+    yes|true|1) ;;
+    *) continue ;;
+  esac
+  cut -f1 "${tmpdir}/zones.${n}" | \
+    grep -n --extended-regexp -f "$denypatterns" | \
+    cut -d: -f1 >"${tmpdir}/matched" || true
+  awk 'FILENAME == ARGV[1] { matched[$1] = 1; next } FNR in matched' \
+    "${tmpdir}/matched" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+  mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources"
+
+# Drop single-label zones unless they were listed in BLOCK_TLDS, so that a bad
+# entry in a source can't block a whole TLD.
+while read -r n url opts; do
+  case "$url" in
+    tlds:*) continue ;;
+  esac
+  awk -v url="$url" '
+    !index($1, ".") {
+      print "Ignoring TLD " $1 " from " url >"/dev/stderr"
+      next
+    }
+    { print }' "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+  mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources"
+
+# Functions for an awk program with the Public Suffix List's rules in the
+# "rules" array. The list contains rules like "co.uk", wildcards like "*.ck"
+# matching all children of a suffix, and exceptions like "!www.ck".
+# registrable() returns the domain one label below a name's public suffix
+# (e.g. "example.co.uk" for "www.example.co.uk"), or an empty string if the
+# name is a public suffix itself.
+PSL_AWK='
+  function is_suffix(d,   p) {
+    if (("!" d) in rules) return 0
+    if (d in rules) return 1
+    p = d
+    return sub(/^[^.]*\./, "", p) && ("*." p) in rules
+  }
+  function registrable(d,   prev) {
+    prev = ""
+    while (index(d, ".") && !is_suffix(d)) {
+      prev = d
+      sub(/^[^.]*\./, "", d)
+    }
+    return prev
+  }'
+
+# Drop public suffixes.
+if [ -n "$PSL_URL" ]; then
+  sed -e 's/\s.*//' -e '/^\/\//d' -e '/^$/d' "${tmpdir}/psl.1" | \
+    tr A-Z a-z >"${tmpdir}/suffixes"
+  while read -r n url opts; do
+    case "$url $(source_opt "$opts" public-suffixes no)" in
+      tlds:*|*" yes"|*" true"|*" 1") continue ;;
+    esac
+    awk -v url="$url" "$PSL_AWK"'
+      FILENAME == ARGV[1] { rules[$1] = 1; next }
+      is_suffix($1) {
+        print "Ignoring public suffix " $1 " from " url >"/dev/stderr"
+        next
+      }
+      { print }' "${tmpdir}/suffixes" "${tmpdir}/zones.${n}" \
+      >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Drop zones that aren't listed by enough sources.
+if [ "$MIN_SOURCES" -gt 1 ]; then
+  while read -r n url opts; do
+    cut -f1 "${tmpdir}/zones.${n}" | sort -u
+  done <"${tmpdir}/sources" | sort | uniq -c | \
+    awk -v min="$MIN_SOURCES" '$1 >= min { print $2 }' >"${tmpdir}/consensus"
+  while read -r n url opts; do
+    awk 'FILENAME == ARGV[1] { keep[$1] = 1; next } $1 in keep' \
+      "${tmpdir}/consensus" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Drop zones whose sources' weights don't add up to MIN_SCORE.
+if [ "$MIN_SCORE" != 0 ]; then
+  while read -r n url opts; do
+    cut -f1 "${tmpdir}/zones.${n}" | sort -u | \
+      awk -v w="$(source_opt "$opts" weight 1)" '{ print $1, w }'
+  done <"${tmpdir}/sources" | \
+    awk -v min="$MIN_SCORE" '
+      { score[$1] += $2 }
+      END { for (z in score) if (score[z] >= min + 0) print z }' \
+    >"${tmpdir}/consensus"
+  while read -r n url opts; do
+    awk 'FILENAME == ARGV[1] { keep[$1] = 1; next } $1 in keep' \
+      "${tmpdir}/consensus" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Replace zones with their registrable domains when more than
+# ROLLUP_THRESHOLD zones are listed under them. Domains containing allowed
+# names or SAFE_ZONES aren't rolled up, since blocking them would block those
+# names.
+if [ "$ROLLUP_THRESHOLD" -gt 0 ]; then
+  { cat "${tmpdir}"/allowed.*; literal_allows; } | cut -f1 | cut -d' ' -f1 \
+    >"${tmpdir}/rollup-allowed"
+  while read -r n url opts; do
+    cut -f1 "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" | sort -u | \
+    awk -v max="$ROLLUP_THRESHOLD" "$PSL_AWK"'
+      FILENAME == ARGV[1] { rules[$1] = 1; next }
+      FILENAME == ARGV[2] {
+        if ((r = registrable($1)) != "") allowed[r] = 1
+        next
+      }
+      (r = registrable($1)) != "" && !(r in allowed) { count[r]++ }
+      END { for (r in count) if (count[r] > max) print r }' \
+    "${tmpdir}/suffixes" "${tmpdir}/rollup-allowed" - >"${tmpdir}/rollups"
+  while read -r n url opts; do
+    awk -F '\t' -v OFS='\t' "$PSL_AWK"'
+      FILENAME == ARGV[1] { rules[$1] = 1; next }
+      FILENAME == ARGV[2] { rollup[$1] = 1; next }
+      (r = registrable($1)) in rollup { $1 = r }
+      { print }' "${tmpdir}/suffixes" "${tmpdir}/rollups" \
+      "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Count the sources listing each zone for MAX_ZONES before they're deduplicated.
+if [ "$MAX_ZONES" -gt 0 ]; then
+  while read -r n url opts; do
+    cut -f1 "${tmpdir}/zones.${n}" | sort -u
+  done <"${tmpdir}/sources" | sort | uniq -c | awk '{ print $2, $1 }' \
+    >"${tmpdir}/counts"
+fi
+
+# Write the URLs of the sources listing each zone to "${tmpdir}/zone-sources"
+# as "ZONE URL[,URL]..." lines for ANNOTATE.
+: >"${tmpdir}/zone-sources"
+if [ -n "$ANNOTATE" ]; then
+  while read -r n url opts; do
+    awk -v url="$url" '{ print $1, url }' "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" | awk '
+    { urls[$1] = urls[$1] (urls[$1] == "" ? "" : ",") $2 }
+    END { for (z in urls) print z, urls[z] }' >"${tmpdir}/zone-sources"
+fi
+
+# Functions for an awk program with a source's action in the "action" variable
+# and CATEGORY_ACTIONS in the "catactions" variable. zone_action() returns the
+# action for the zone on the current line: the one for the first of its
+# categories that is in CATEGORY_ACTIONS, or else the source's action.
+ZONE_ACTION_AWK='
+  BEGIN {
+    npairs = split(catactions, pairs, " ")
+    for (ipair = 1; ipair <= npairs; ipair++) {
+      split(pairs[ipair], kv, "=")
+      catact[kv[1]] = kv[2]
+    }
+  }
+  function zone_action(   i, n, cats) {
+    n = split($2, cats, ",")
+    for (i = 1; i <= n; i++) if (cats[i] in catact) return catact[cats[i]]
+    return action
+  }'
+
+# Functions for an awk program with CATEGORY_SCHEDULES in the "catscheds"
+# variable. category_schedule() returns the first of the categories of the zone
+# on the current line that has a schedule, or "" if there isn't one.
+CATEGORY_SCHEDULE_AWK='
+  BEGIN {
+    nscheds = split(catscheds, scheds, " ")
+    for (isched = 1; isched <= nscheds; isched++) {
+      split(scheds[isched], kv, "=")
+      catsched[kv[1]] = 1
+    }
+  }
+  function category_schedule(   i, n, cats) {
+    n = split($2, cats, ",")
+    for (i = 1; i <= n; i++) if (cats[i] in catsched) return cats[i]
+    return ""
+  }'
+
+# Write the zones that sources block at all times to "${tmpdir}/always" as
+# "ZONE TAG[,TAG]..." lines (with "-" for zones blocked for all clients), so
+# scheduling doesn't unblock them. Zones from audited and scheduled sources and
+# ones that CATEGORY_SCHEDULES apply to are omitted. Like the tags, this needs
+# to happen before zones are deduplicated.
+: >"${tmpdir}/always"
+if [ -n "$CATEGORY_SCHEDULES" ] || \
+    grep -q '[[:space:]]schedule=' "${tmpdir}/sources"; then
+  while read -r n url opts; do
+    action=$(source_opt "$opts" action "$ACTION")
+    [ "$action" != audit ] || continue
+    [ -z "$(source_opt "$opts" schedule)" ] || continue
+    awk -v action="$action" -v catactions="$CATEGORY_ACTIONS" \
+      -v catscheds="$CATEGORY_SCHEDULES" \
+      -v tags="$(source_opt "$opts" clients)" \
+      "${ZONE_ACTION_AWK}${CATEGORY_SCHEDULE_AWK}"'
+      tags != "" { print $1, tags; next }
+      zone_action() == "redirect" || category_schedule() == "" {
+        print $1, "-"
+      }' "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" | awk '
+    $2 == "-" { all[$1] = 1 }
+    { tags[$1] = tags[$1] "," $2 }
+    END { for (z in tags) print z, (z in all ? "-" : substr(tags[z], 2)) }' \
+    >"${tmpdir}/always"
+fi
+
+# Write the tags of the clients that each zone is blocked for to
+# "${tmpdir}/zone-tags" as "ZONE TAG[,TAG]..." lines. Zones blocked for all
+# clients by any source are omitted. This needs to happen before zones are
+# deduplicated, since each source can block them for different clients.
+: >"${tmpdir}/zone-tags"
+if [ -n "$CLIENT_TAGS" ]; then
+  while read -r n url opts; do
+    awk -v tags="$(source_opt "$opts" clients)" \
+      '{ print $1, (tags == "" ? "-" : tags) }' "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" | awk '
+    $2 == "-" { all[$1] = 1; next }
+    {
+      n = split($2, t, ",")
+      for (i = 1; i <= n; i++) {
+        if (seen[$1, t[i]]++) continue
+        tags[$1] = tags[$1] (tags[$1] == "" ? "" : ",") t[i]
+      }
+    }
+    END { for (z in tags) if (!(z in all)) print z, tags[z] }' \
+    >"${tmpdir}/zone-tags"
+fi
+
+# Drop zones that were already listed by earlier sources. Scheduled and then
+# audited sources are handled last so they don't take zones from sources that
+# always block them.
+awk '
+  FNR == 1 { if (out) close(out); out = FILENAME ".new"; printf "" >out }
+  !seen[$1]++ { print >out }' \
+  $(awk -v dir="$tmpdir" '
+    /[ \t]action=audit([ \t]|$)/ { audit = audit " " dir "/zones." $1; next }
+    /[ \t]schedule=/ { sched = sched " " dir "/zones." $1; next }
+    { print dir "/zones." $1 }
+    END { print sched audit }' "${tmpdir}/sources")
+for f in "${tmpdir}"/zones.*.new; do
+  [ -f "$f" ] && mv "$f" "${f%.new}"
+done
+
+# Drop audited zones within zones that other sources block. Unbound's inform
+# type (and RPZ passthru) answers queries normally, so they would otherwise
+# unblock names that are blocked without the audited source.
+while read -r n url opts; do
+  [ "$(source_opt "$opts" action "$ACTION")" != audit ] || continue
+  cut -f1 "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources" >"${tmpdir}/enforced"
+while read -r n url opts; do
+  [ "$(source_opt "$opts" action "$ACTION")" = audit ] || continue
+  awk '
+    FILENAME == ARGV[1] { blocked[$1] = 1; next }
+    {
+      z = $1
+      while (sub(/^[^.]*\./, "", z)) if (z in blocked) next
+      print
+    }' "${tmpdir}/enforced" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+  mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources"
+
+# Drop names that are redirected for SafeSearch, along with their targets.
+if [ -n "$SAFESEARCH" ]; then
+  while read -r n url opts; do
+    echo "$SAFESEARCH_REDIRECTS" | \
+      awk -F '\t' '
+        FILENAME == "-" {
+          split($0, f, " ")
+          redirect[f[1]] = 1
+          redirect[f[2]] = 1
+          next
+        }
+        !($1 in redirect)' - "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Print the SafeSearch redirects as "NAME TARGET" lines if they're enabled.
+safesearch_redirects() {
+  if [ -n "$SAFESEARCH" ]; then
+    echo "$SAFESEARCH_REDIRECTS" | awk 'NF == 2 { print $1, $2 }'
+  fi
+}
+
+# Write the zones of sources with schedule= options and of CATEGORY_SCHEDULES
+# categories to "${tmpdir}/scheduled.N" (with N being "c-CATEGORY" for the
+# latter) as "ZONE TYPE" lines for the schedule command, and record the
+# schedules in "${tmpdir}/schedules" as "N SCHEDULE MODE on|off" lines. The
+# zones of inactive schedules are left out of the config, except for ones from
+# sources with clients= options (MODE "tags"), which are written as
+# transparent zones so the schedule command can block them later without
+# losing their tags. The zones of category schedules are also written to
+# "${tmpdir}/zone-schedules" as "ZONE c-CATEGORY" lines.
+now=$(date '+%w %H:%M')
+: >"${tmpdir}/zone-schedules"
+off=
+for p in $CATEGORY_SCHEDULES; do
+  : >"${tmpdir}/scheduled.c-${p%%=*}"
+  if schedule_active "${p#*=}" "$now"; then
+    echo "c-${p%%=*} ${p#*=} zones on"
+  else
+    echo "c-${p%%=*} ${p#*=} zones off"
+    off="${off} ${p%%=*}"
+  fi
+done >"${tmpdir}/schedules"
+while read -r n url opts; do
+  spec=$(source_opt "$opts" schedule)
+  tags=$(source_opt "$opts" clients)
+  action=$(source_opt "$opts" action "$ACTION")
+  if [ -z "$spec" ]; then
+    [ -n "$CATEGORY_SCHEDULES" ] && [ -z "$tags" ] || continue
+    [ "$action" != audit ] || continue
+    awk -v action="$action" -v catactions="$CATEGORY_ACTIONS" \
+      -v catscheds="$CATEGORY_SCHEDULES" -v off="$off " -v dir="$tmpdir" \
+      "${ZONE_ACTION_AWK}${CATEGORY_SCHEDULE_AWK}"'
+      FILENAME == ARGV[1] { always[$1] = $2; next }
+      {
+        a = zone_action()
+        c = category_schedule()
+        if (a == "redirect" || c == "" || always[$1] == "-") { print; next }
+        print $1, a >>(dir "/scheduled.c-" c)
+        print $1, "c-" c >>(dir "/zone-schedules")
+        if (index(off, " " c " ") == 0) print
+      }' "${tmpdir}/always" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+    continue
+  fi
+  mode=zones
+  if [ -n "$tags" ]; then
+    # Transparent zones would let the tagged clients through blocked parents.
+    mode=tags
+    awk -v tags=",${tags}," '
+      FILENAME == ARGV[1] { always[$1] = $2; next }
+      {
+        z = $1
+        while (sub(/^[^.]*\./, "", z)) {
+          if (!(z in always)) continue
+          if (always[z] == "-") next
+          n = split(always[z], t, ",")
+          for (i = 1; i <= n; i++) if (index(tags, "," t[i] ",")) next
+        }
+        print
+      }' "${tmpdir}/always" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  fi
+  awk -v action="$action" -v catactions="$CATEGORY_ACTIONS" "$ZONE_ACTION_AWK"'
+    { a = zone_action(); print $1, (a == "audit" ? "inform" : a) }' \
+    "${tmpdir}/zones.${n}" >"${tmpdir}/scheduled.${n}"
+  if schedule_active "$spec" "$now"; then
+    echo "$n $spec $mode on"
+  else
+    echo "$n $spec $mode off"
+    [ "$mode" = tags ] || : >"${tmpdir}/zones.${n}"
+  fi
+done <"${tmpdir}/sources" >>"${tmpdir}/schedules"
+
+# Drop zones whose parent zones are also blocked with the same action, since
+# the parent's entry already covers them.
+if [ -n "$COLLAPSE_SUBDOMAINS" ]; then
+  # Zones with the redirect action only cover ones with the same addresses.
+  # Tagged and scheduled zones only cover ones with the same tags and
+  # schedules.
+  zone_key='
+    function zone_key(   a) {
+      a = zone_action()
+      return (a == "redirect" ? a ":" sinkhole : a) "/" tags[$1] "/" \
+        ($1 in sched ? sched[$1] : schedule)
+    }
+    FILENAME == tagfile { tags[$1] = $2; next }
+    FILENAME == schedfile { sched[$1] = $2; next }'
+  while read -r n url opts; do
+    awk -v action="$(source_opt "$opts" action "$ACTION")" \
+      -v sinkhole="$(source_opt "$opts" sinkhole "$SINKHOLE")" \
+      -v catactions="$CATEGORY_ACTIONS" -v tagfile="${tmpdir}/zone-tags" \
+      -v schedule="$(source_opt "$opts" schedule)" \
+      -v schedfile="${tmpdir}/zone-schedules" \
+      "${ZONE_ACTION_AWK}${zone_key}"'
+      { print $1, zone_key() }' "${tmpdir}/zone-tags" \
+      "${tmpdir}/zone-schedules" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" >"${tmpdir}/blocked"
+  while read -r n url opts; do
+    awk -v action="$(source_opt "$opts" action "$ACTION")" \
+      -v sinkhole="$(source_opt "$opts" sinkhole "$SINKHOLE")" \
+      -v catactions="$CATEGORY_ACTIONS" -v tagfile="${tmpdir}/zone-tags" \
+      -v schedule="$(source_opt "$opts" schedule)" \
+      -v schedfile="${tmpdir}/zone-schedules" \
+      "${ZONE_ACTION_AWK}${zone_key}"'
+      FILENAME == ARGV[3] { blocked[$1] = $2; next }
+      {
+        z = $1
+        key = zone_key()
+        while (sub(/^[^.]*\./, "", z)) {
+          if (z in blocked && blocked[z] == key) next
+        }
+        print
+      }' "${tmpdir}/zone-tags" "${tmpdir}/zone-schedules" "${tmpdir}/blocked" \
+      "${tmpdir}/zones.${n}" \
+      >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Keep the MAX_ZONES zones with the highest priority.
+if [ "$MAX_ZONES" -gt 0 ]; then
+  while read -r n url opts; do
+    awk -F '\t' -v n="$n" -v prio="$(source_opt "$opts" priority 0)" \
+      -v want="$PRIORITY_CATEGORIES" '
+      BEGIN {
+        k = split(want, w, ",")
+        for (i = 1; i <= k; i++) wanted[w[i]] = 1
+      }
+      FILENAME == ARGV[1] { split($0, f, " "); count[f[1]] = f[2]; next }
+      {
+        c = 0
+        k = split($2, cats, ",")
+        for (i = 1; i <= k; i++) if (cats[i] in wanted) c = 1
+        print c "\t" prio "\t" count[$1] "\t" n "\t" $1
+      }' "${tmpdir}/counts" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources" | \
+    sort -s -t "$(printf '\t')" -k1,1nr -k2,2nr -k3,3nr -k4,4n | \
+    awk -F '\t' -v max="$MAX_ZONES" '
+      NR <= max { print $5 }
+      END {
+        if (NR > max) {
+          print "Dropping " NR - max " zones over MAX_ZONES" >"/dev/stderr"
+        }
+      }' \
+    >"${tmpdir}/kept"
+  while read -r n url opts; do
+    awk -F '\t' 'FILENAME == ARGV[1] { keep[$1] = 1; next } $1 in keep' \
+      "${tmpdir}/kept" "${tmpdir}/zones.${n}" >"${tmpdir}/zones.${n}.new"
+    mv "${tmpdir}/zones.${n}.new" "${tmpdir}/zones.${n}"
+  done <"${tmpdir}/sources"
+fi
+
+# Sort each source's zones so that the output only changes when the set of
+# zones does, rather than when lists reorder their entries.
+while read -r n url opts; do
+  LC_ALL=C sort -o "${tmpdir}/zones.${n}" "${tmpdir}/zones.${n}"
+done <"${tmpdir}/sources"
+
+# Write an Unbound config file containing local-zone directives to stdout.
+write_unbound() {
+  # The 'server:' directive here is required.
+  echo "# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo "server:"
+  if [ -n "$CLIENT_TAGS" ]; then
+    echo
+    for p in $CLIENT_TAGS; do
+      echo "${p%%=*}"
+    done | awk '
+      { t = t (NR > 1 ? " " : "") $1 }
+      END { print "define-tag: \"" t "\"" }'
+    for p in $CLIENT_TAGS; do
+      for net in $(echo "${p#*=}" | tr , ' '); do
+        echo "access-control-tag: ${net} \"${p%%=*}\""
+      done
+    done
+  fi
+  sources | while read -r i url opts; do
+    echo
+    echo "# ${url}"
+    awk -v action="$(source_opt "$opts" action "$ACTION")" \
+      -v sinkhole="$(source_opt "$opts" sinkhole "$SINKHOLE")" \
+      -v catactions="$CATEGORY_ACTIONS" \
+      -v paused="$(awk -v n="$i" '$1 == n && $4 == "off"' \
+        "${tmpdir}/schedules")" \
+      "$ZONE_ACTION_AWK"'
+      BEGIN { n = split(sinkhole, addrs, ",") }
+      FILENAME == ARGV[1] { tags[$1] = $2; next }
+      FILENAME == ARGV[2] { from[$1] = " # " $2; next }
+      {
+        a = paused ? "transparent" : zone_action()
+        print "local-zone: \""$1"\" "(a == "audit" ? "inform" : a) from[$1]
+        if ($1 in tags) {
+          t = tags[$1]
+          gsub(/,/, " ", t)
+          print "local-zone-tag: \""$1"\" \"" t "\""
+        }
+        if (a != "redirect") next
+        for (i = 1; i <= n; i++) {
+          type = index(addrs[i], ":") ? "AAAA" : "A"
+          print "local-data: \""$1" "type" "addrs[i]"\""
+        }
+      }' "${tmpdir}/zone-tags" "${tmpdir}/zone-sources" "${tmpdir}/zones.${i}"
+  done
+  # Literally allowed names within blocked zones are overridden so they still
+  # resolve. Unbound's transparent zones also cover their subdomains.
+  literal_allows | awk '
+    FILENAME == "-" { allowed[$1] = 1; next }
+    { blocked[$1] = 1 }
+    END {
+      for (z in allowed) {
+        d = z
+        while (sub(/^[^.]*\./, "", d)) {
+          if (d in blocked) { print z; break }
+        }
+      }
+    }' - $(enforced_sources |
+      awk -v dir="$tmpdir" '{ print dir "/zones." $1 }') | \
+    LC_ALL=C sort | awk '
+    NR == 1 { print ""; print "# Allowed" }
+    { print "local-zone: \""$1"\" transparent" }'
+  # Redirect zones also cover their subdomains, so targets within them (e.g.
+  # safe.duckduckgo.com) are passed through instead of redirected to
+  # themselves.
+  safesearch_redirects | awk '
+    NR == 1 { print ""; print "# SafeSearch" }
+    {
+      print "local-zone: \""$1"\" redirect"
+      print "local-data: \""$1" CNAME "$2".\""
+      redirect[$1] = 1
+      target[NR] = $2
+    }
+    END {
+      for (i = 1; i <= NR; i++) {
+        t = target[i]
+        if (t in redirect || done[t]++) continue
+        z = t
+        while (sub(/^[^.]*\./, "", z)) {
+          if (z in redirect) {
+            print "local-zone: \""t"\" transparent"
+            break
+          }
+        }
+      }
+    }'
+}
+
+# Split the Unbound config file at $1 into files containing at most $chunksize
+# zones each in the directory at $2, which is created. Each file gets its own
+# header.
+split_unbound() {
+  mkdir "$2"
+  awk -v dir="$2" -v size="$chunksize" '
+    NR == 1 { header = $0; next }
+    $0 == "server:" { next }
+    /^local-zone:/ {
+      if (count % size == 0) {
+        if (file) close(file)
+        file = sprintf("%s/blocklist-%03d.conf", dir, count / size)
+        print header >file
+        print "server:" >file
+        printf "%s", pending >file
+        pending = ""
+      }
+      count++
+    }
+    file { print >file; next }
+    { pending = pending $0 "\n" }' "$1"
+}
+
+# Split the Unbound config file at $1 into one file per source in the directory
+# at $2, which is created. Files are named after their sources' positions and
+# URLs, so a source can be disabled until the next run by deleting its file.
+# Directives that precede the first source go in "blocklist-000.conf".
+split_unbound_sources() {
+  mkdir "$2"
+  awk -v dir="$2" '
+    function start(f) {
+      if (file) close(file)
+      file = f
+      print header >file
+      print "server:" >file
+      printf "%s", pending >file
+      pending = ""
+    }
+    NR == 1 { header = $0; next }
+    $0 == "server:" { next }
+    /^# / && prev == "" {
+      if (pending != "") start(dir "/blocklist-000.conf")
+      if ($0 == "# SafeSearch") {
+        name = "safesearch"
+      } else if ($0 == "# Allowed") {
+        name = "allowed"
+      } else {
+        name = substr($0, 3)
+        sub(/^[a-z+]*:\/*/, "", name)
+        gsub(/[^A-Za-z0-9.-]+/, "_", name)
+        gsub(/^_+|_+$/, "", name)
+        name = sprintf("%03d-%s", ++count, substr(name, 1, 64))
+      }
+      start(dir "/blocklist-" name ".conf")
+    }
+    { prev = $0 }
+    $0 == "" { next }
+    file { print >file; next }
+    { pending = pending $0 "\n" }
+    END { if (pending != "") start(dir "/blocklist-000.conf") }' "$1"
+}
+
+# Write an Unbound config file to stdout that includes the chunk files.
+write_chunk_index() {
+  echo "# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo "include: \"${CHUNK_DIR}/blocklist-*.conf\""
+}
+
+# Give the files at $@ FILE_OWNER and FILE_MODE before they're installed.
+set_perms() {
+  if [ -n "$FILE_OWNER" ]; then
+    chown "$FILE_OWNER" "$@"
+  fi
+  chmod "$FILE_MODE" "$@"
+}
+
+# Restore the default SELinux contexts of the installed files at $@ (some of
+# which may be directories), if SELinux is enabled.
+restore_contexts() {
+  if command -v selinuxenabled >/dev/null && selinuxenabled && \
+      command -v restorecon >/dev/null; then
+    restorecon -R "$@"
+  fi
+}
+
+# Copy the directory at $1 to a new directory next to $CHUNK_DIR for
+# install_chunks and print the new directory's path.
+stage_chunks() {
+  new=$(mktemp -d "${CHUNK_DIR}.XXXXXX")
+  cp "$1"/* "$new"
+  set_perms "$new"/*
+  chmod 755 "$new"
+  if [ -n "$FILE_OWNER" ]; then
+    chown "$FILE_OWNER" "$new"
+  fi
+  restore_contexts "$new"
+  echo "$new"
+}
+
+# Atomically replace $CHUNK_DIR with the directory at $1 created by
+# stage_chunks. The previous files are kept in "${CHUNK_DIR}.bak".
+install_chunks() {
+  old=
+  if [ -L "$CHUNK_DIR" ]; then
+    old=$(readlink -f "$CHUNK_DIR")
+  elif [ -d "$CHUNK_DIR" ]; then
+    # Move an unmanaged directory out of the way the first time.
+    old="${CHUNK_DIR}.old"
+    mv "$CHUNK_DIR" "$old"
+  fi
+  ln -s "$1" "${1}.link"
+  mv -T "${1}.link" "$CHUNK_DIR"
+  if [ -n "$old" ]; then
+    rm -rf "${CHUNK_DIR}.bak"
+    mv "$old" "${CHUNK_DIR}.bak"
+  fi
+}
+
+# Write the zones to stdout in sorted order, one per line. Zones listed by
+# multiple sources are only written once.
+write_domains() {
+  enforced_sources | while read -r i url opts; do
+    cut -f1 "${tmpdir}/zones.${i}"
+  done | LC_ALL=C sort -u
+}
+
+# Write the zones to stdout like write_domains, each followed by "exact" if
+# literally allowed names are within it or "subtree" otherwise. Formats without
+# exceptions only block the exact zones themselves so the names still resolve,
+# at the cost of not blocking the zones' other subdomains.
+write_domain_scopes() {
+  write_domains >"${tmpdir}/domains"
+  literal_allows | awk '
+    FILENAME == "-" { allowed[$1] = 1; next }
+    { zones[++n] = $1; blocked[$1] = 1 }
+    END {
+      for (z in allowed) {
+        d = z
+        while (sub(/^[^.]*\./, "", d)) {
+          if (d in blocked) exact[d] = 1
+        }
+      }
+      for (i = 1; i <= n; i++) {
+        print zones[i], (zones[i] in exact ? "exact" : "subtree")
+      }
+    }' - "${tmpdir}/domains"
+}
+
+# Write a Palo Alto External Dynamic List of domains to stdout. EDLs can't
+# contain comments, and wildcard entries are needed to block subdomains.
+write_edl() {
+  write_domain_scopes | awk '{print $1; if ($2 == "subtree") print "*."$1}'
+}
+
+# Write a Squid dstdomain ACL file to stdout. Squid warns about entries that
+# are already covered by a parent domain's entry, so those are omitted. Zones
+# containing allowed names are listed without the leading '.' that would also
+# match their subdomains.
+write_squid() {
+  echo "# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  write_domain_scopes | awk '
+    { zones[NR] = $1; if ($2 == "subtree") seen[$1] = 1; else exact[$1] = 1 }
+    END {
+      for (i = 1; i <= NR; i++) {
+        z = zones[i]
+        covered = 0
+        while (!covered && (j = index(z, ".")) > 0) {
+          z = substr(z, j + 1)
+          if (z in seen) covered = 1
+        }
+        if (covered) continue
+        print (zones[i] in exact) ? zones[i] : "."zones[i]
+      }
+    }'
+}
+
+# Print the lines in the sorted file at $2 that aren't in the sorted file at $1.
+added_lines() {
+  comm -13 "$1" "$2"
+}
+
+# Print the unique zones from the last successful run in sorted order.
+previous_zones() {
+  cat "${STATE_DIR}/zones" 2>/dev/null || true
+}
+
+# Save the zones from this run for comparison by the next one.
+save_state() {
+  mkdir -p "$STATE_DIR"
+  write_domains | LC_ALL=C sort >"${STATE_DIR}/zones.new"
+  mv "${STATE_DIR}/zones.new" "${STATE_DIR}/zones"
+  if [ -f "${tmpdir}/feed-entries" ]; then
+    mv "${tmpdir}/feed-entries" "${STATE_DIR}/feed-entries"
+  fi
+}
+
+# Maximum number of added or removed zones to list in the report.
+REPORT_MAX_CHANGES=500
+
+# Write a Markdown report describing the sources, allow pattern matches, and
+# zones added and removed since the last run to stdout.
+write_report_markdown() {
+  echo "# Blocklist report"
+  echo
+  echo "Generated by \`$(readlink -f $0)\` at $(date --rfc-3339=seconds)."
+  echo
+  echo "## Sources"
+  echo
+  echo "| Source | Entries | Allowed | Zones |"
+  echo "| --- | ---: | ---: | ---: |"
+  sources | while read -r i url opts; do
+    echo "| ${url} | $(wc -l <"${tmpdir}/parsed.${i}")" \
+      "| $(wc -l <"${tmpdir}/allowed.${i}")" \
+      "| $(wc -l <"${tmpdir}/zones.${i}") |"
+  done
+  echo
+  echo "## Allow patterns"
+  echo
+  echo "| Pattern | Matches |"
+  echo "| --- | ---: |"
+  cat "${tmpdir}"/allowed.* | cut -f1 >"${tmpdir}/allowed"
+  while read -r pat; do
+    echo "| \`$(echo "$pat" | sed -e 's/|/\\|/g')\`" \
+      "| $(grep -c -E -e "$pat" "${tmpdir}/allowed" || true) |"
+  done <"$allow"
+  echo
+  echo "## Changes since last run"
+  write_domains | LC_ALL=C sort >"${tmpdir}/current"
+  previous_zones >"${tmpdir}/previous"
+  for kind in Added Removed; do
+    if [ "$kind" = Added ]; then
+      added_lines "${tmpdir}/previous" "${tmpdir}/current" >"${tmpdir}/changes"
+    else
+      added_lines "${tmpdir}/current" "${tmpdir}/previous" >"${tmpdir}/changes"
+    fi
+    echo
+    echo "### ${kind} ($(wc -l <"${tmpdir}/changes"))"
+    echo
+    awk -v max="$REPORT_MAX_CHANGES" '
+      NR <= max { print "- `"$1"`" }
+      END { if (NR > max) print "- ...and " NR - max " more" }' \
+      "${tmpdir}/changes"
+  done
+}
+
+# Write the report as a minimal HTML page to stdout.
+write_report_html() {
+  echo "<!DOCTYPE html>"
+  echo "<html><head><meta charset=\"utf-8\">"
+  echo "<title>Blocklist report</title></head>"
+  echo "<body>"
+  write_report_markdown | sed -e 's/&/\&amp;/g' -e 's/</\&lt;/g' \
+    -e 's/>/\&gt;/g' | awk '
+    function code(s) {
+      while (match(s, /`[^`]*`/)) {
+        s = substr(s, 1, RSTART - 1) "<code>" \
+          substr(s, RSTART + 1, RLENGTH - 2) "</code>" \
+          substr(s, RSTART + RLENGTH)
+      }
+      return s
+    }
+    function endlist() { if (inlist) print "</ul>"; inlist = 0 }
+    function endtable() { if (intable) print "</table>"; intable = 0 }
+    /^#+ / {
+      endlist(); endtable()
+      level = index($0, " ") - 1
+      print "<h" level ">" code(substr($0, level + 2)) "</h" level ">"
+      next
+    }
+    /^\| --- / { next }
+    /^\| / {
+      endlist()
+      tag = intable ? "td" : "th"
+      if (!intable) print "<table>"
+      intable = 1
+      row = substr($0, 3, length($0) - 4)
+      gsub(/\\\|/, "\001", row)
+      n = split(row, cells, / \| /)
+      line = "<tr>"
+      for (i = 1; i <= n; i++) {
+        gsub(/\001/, "|", cells[i])
+        line = line "<" tag ">" code(cells[i]) "</" tag ">"
+      }
+      print line "</tr>"
+      next
+    }
+    /^- / {
+      endtable()
+      if (!inlist) print "<ul>"
+      inlist = 1
+      print "<li>" code(substr($0, 3)) "</li>"
+      next
+    }
+    /^$/ { endlist(); endtable(); next }
+    { print "<p>" code($0) "</p>" }
+    END { endlist(); endtable() }'
+  echo "</body></html>"
+}
+
+# Write the report to stdout in the format implied by the path at $1.
+write_report() {
+  case "$1" in
+    *.html|*.htm) write_report_html ;;
+    *) write_report_markdown ;;
+  esac
+}
+
+# Write a JSON object describing the run to stdout. Each source's "skipped"
+# count is the number of its entries that were neither allowed nor emitted
+# (e.g. duplicates and zones below MIN_SOURCES).
+write_manifest() {
+  echo "{"
+  echo "  \"generated\": \"$(date --rfc-3339=seconds)\","
+  echo "  \"zones\": $(write_domains | wc -l),"
+  echo "  \"sources\": ["
+  sources | while read -r i url opts; do
+    failed=false
+    [ -e "${tmpdir}/raw.${i}.failed" ] && failed=true
+    read -r bytes hash <"${tmpdir}/fetched.${i}"
+    entries=$(wc -l <"${tmpdir}/parsed.${i}")
+    allowed=$(wc -l <"${tmpdir}/allowed.${i}")
+    zones=$(wc -l <"${tmpdir}/zones.${i}")
+    # Rolled-up zones aren't among the source's entries.
+    skipped=$((entries - allowed - zones))
+    [ "$skipped" -ge 0 ] || skipped=0
+    [ "$i" -gt 1 ] && echo ","
+    printf '    {"url": "%s", "failed": %s, "bytes": %d, "sha256": "%s", ' \
+      "$(echo "$url" | sed -e 's/[\\"]/\\&/g')" "$failed" "$bytes" "$hash"
+    printf '"entries": %d, "allowed": %d, "skipped": %d, "zones": %d}' \
+      "$entries" "$allowed" "$skipped" "$zones"
+  done
+  echo
+  echo "  ]"
+  echo "}"
+}
+
+# Maximum number of runs listed in the feed.
+FEED_MAX_ENTRIES=50
+
+# Write an Atom feed to stdout with an entry listing the zones added and removed
+# by each run that changed them. Earlier entries are saved in
+# "${STATE_DIR}/feed-entries" by save_state, and no entry is added for the
+# first run. Like the other outputs, the feed is only written and its new entry
+# saved once the Unbound config has been installed.
+write_feed() {
+  now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+  id="urn:update-blocklist:$(uname -n)"
+  write_domains | LC_ALL=C sort >"${tmpdir}/current"
+  previous_zones >"${tmpdir}/previous"
+  added_lines "${tmpdir}/previous" "${tmpdir}/current" >"${tmpdir}/added"
+  added_lines "${tmpdir}/current" "${tmpdir}/previous" >"${tmpdir}/removed"
+  {
+    if [ -f "${STATE_DIR}/zones" ] && \
+        { [ -s "${tmpdir}/added" ] || [ -s "${tmpdir}/removed" ]; }; then
+      echo "<entry>"
+      echo "<title>$(wc -l <"${tmpdir}/added") added," \
+        "$(wc -l <"${tmpdir}/removed") removed</title>"
+      echo "<id>${id}:${now}</id>"
+      echo "<updated>${now}</updated>"
+      echo "<content type=\"text\">"
+      for f in added removed; do
+        sign=+
+        [ "$f" = added ] || sign=-
+        awk -v max="$REPORT_MAX_CHANGES" -v sign="$sign" '
+          NR <= max { print sign " " $1 }
+          END { if (NR > max) print sign " ...and " NR - max " more" }' \
+          "${tmpdir}/${f}"
+      done
+      echo "</content>"
+      echo "</entry>"
+    fi
+    cat "${STATE_DIR}/feed-entries" 2>/dev/null || true
+  } | awk -v max="$FEED_MAX_ENTRIES" '$0 == "<entry>" { n++ } n <= max' \
+    >"${tmpdir}/feed-entries"
+  echo '<?xml version="1.0" encoding="utf-8"?>'
+  echo '<feed xmlns="http://www.w3.org/2005/Atom">'
+  echo "<title>Blocklist changes on $(uname -n)</title>"
+  echo "<id>${id}</id>"
+  echo "<updated>$(sed -n 's|^<updated>\(.*\)</updated>$|\1|p' \
+    "${tmpdir}/feed-entries" | head -n1 | grep . || echo "$now")</updated>"
+  echo "<author><name>$(readlink -f $0)</name></author>"
+  cat "${tmpdir}/feed-entries"
+  echo "</feed>"
+}
+
+# Write an Adblock Plus filter list to stdout for use by browser blockers.
+# Literal allow patterns are written as exception rules. Note that ABP
+# exceptions always apply to subdomains too.
+write_adblock() {
+  echo "[Adblock Plus 2.0]"
+  echo "! Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo
+  allow_urls | sed -e 's/^/! /'
+  literal_allows | awk '{print "@@||"$1"^"}'
+  enforced_sources | while read -r i url opts; do
+    echo
+    echo "! ${url}"
+    awk '{print "||"$1"^"}' "${tmpdir}/zones.${i}"
+  done
+}
+
+# Write a Lua snippet for dnsdist to stdout that refuses queries for the zones
+# and their subdomains. Literal allow patterns are added as rules that let
+# queries through before the refusal rule is reached.
+write_dnsdist() {
+  echo "-- Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo "do"
+  echo "  local allowExact = newDNSNameSet()"
+  echo "  local allowSuffix = newSuffixMatchNode()"
+  echo "  local deny = newSuffixMatchNode()"
+  echo
+  allow_urls | sed -e 's/^/  -- /'
+  literal_allows | awk '{
+    if ($2 == "subtree") print "  allowSuffix:add(\""$1"\")"
+    else print "  allowExact:add(newDNSName(\""$1"\"))"
+  }'
+  enforced_sources | while read -r i url opts; do
+    echo
+    echo "  -- ${url}"
+    awk '{print "  deny:add(\""$1"\")"}' "${tmpdir}/zones.${i}"
+  done
+  echo
+  echo "  addAction(QNameSetRule(allowExact), AllowAction())"
+  echo "  addAction(SuffixMatchNodeRule(allowSuffix), AllowAction())"
+  echo "  addAction(SuffixMatchNodeRule(deny), RCodeAction(DNSRCode.REFUSED))"
+  echo "end"
+}
+
+# Write an rbldnsd "dnset" dataset to stdout for RHSBL checks by mail servers.
+# Each zone is listed along with its subdomains, and literal allow patterns are
+# written as exclusions.
+write_rbldnsd() {
+  echo "# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo ":127.0.0.2:Blocked domain"
+  echo
+  allow_urls | sed -e 's/^/# /'
+  literal_allows | awk '{print ($2 == "subtree" ? "!." : "!")$1}'
+  enforced_sources | while read -r i url opts; do
+    echo
+    echo "# ${url}"
+    awk '{print "."$1}' "${tmpdir}/zones.${i}"
+  done
+}
+
+# Write the zones to stdout using the template file. This supports a small
+# subset of Go's text/template syntax: the text between "{{range .Zones}}" and
+# "{{end}}" is written once per zone, with "{{.Zone}}", "{{.Source}}", and
+# "{{.Categories}}" replaced by the zone, the URL it came from, and its
+# comma-separated categories, and the text surrounding it is written once as a
+# header and footer. "{{.Time}}" and "{{.Program}}" can be used anywhere.
+write_template() {
+  enforced_sources | while read -r i url opts; do
+    awk -v url="$url" '{print url"\t"$0}' "${tmpdir}/zones.${i}"
+  done | awk -v tmpl="$template" -v now="$(date --rfc-3339=seconds)" \
+    -v prog="$(readlink -f $0)" '
+    function subst(s, key, val,   out, i) {
+      out = ""
+      while ((i = index(s, key)) > 0) {
+        out = out substr(s, 1, i - 1) val
+        s = substr(s, i + length(key))
+      }
+      return out s
+    }
+    function expand(s) {
+      return subst(subst(s, "{{.Time}}", now), "{{.Program}}", prog)
+    }
+    BEGIN {
+      FS = "\t"
+      text = ""
+      while ((getline line <tmpl) > 0) text = text line "\n"
+      start = "{{range .Zones}}"
+      if ((i = index(text, start)) == 0) {
+        header = text
+      } else {
+        header = substr(text, 1, i - 1)
+        body = substr(text, i + length(start))
+        if ((j = index(body, "{{end}}")) == 0) {
+          print "Missing {{end}} in " tmpl >"/dev/stderr"
+          err = 1
+          exit
+        }
+        footer = substr(body, j + length("{{end}}"))
+        body = substr(body, 1, j - 1)
+      }
+      printf "%s", expand(header)
+    }
+    body != "" {
+      s = subst(subst(body, "{{.Zone}}", $2), "{{.Source}}", $1)
+      printf "%s", expand(subst(s, "{{.Categories}}", $3))
+    }
+    END {
+      if (err) exit 1
+      printf "%s", expand(footer)
+    }'
+}
+
+# Write an RPZ zone file to stdout. Each zone is blocked along with its
+# subdomains, and literal allow patterns are emitted as passthru records so
+# they take precedence over wildcards covering them.
+write_rpz_zone() {
+  echo "; Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo "\$TTL 3600"
+  echo "@ SOA localhost. root.localhost. $(date +%s) 3600 600 86400 3600"
+  echo "@ NS localhost."
+  echo
+  allow_urls | sed -e 's/^/; /'
+  literal_allows | awk '{
+    print $1" CNAME rpz-passthru."
+    if ($2 == "subtree") print "*."$1" CNAME rpz-passthru."
+  }'
+  sources | while read -r i url opts; do
+    echo
+    echo "; ${url}"
+    awk -v action="$(source_opt "$opts" action "$ACTION")" \
+      -v sinkhole="$(source_opt "$opts" sinkhole "$SINKHOLE")" \
+      -v catactions="$CATEGORY_ACTIONS" "$ZONE_ACTION_AWK"'
+      BEGIN { n = split(sinkhole, addrs, ",") }
+      FILENAME == ARGV[1] { from[$1] = " ; " $2; next }
+      { a = zone_action() }
+      a == "redirect" {
+        for (i = 1; i <= n; i++) {
+          type = index(addrs[i], ":") ? "AAAA" : "A"
+          print $1" "type" "addrs[i] from[$1]
+          print "*."$1" "type" "addrs[i]
+        }
+        next
+      }
+      {
+        rdata = "CNAME ."
+        if (a == "always_nodata") rdata = "CNAME *."
+        if (a ~ /^(deny|always_deny|inform_deny)$/) rdata = "CNAME rpz-drop."
+        if (a == "always_null") rdata = "A 0.0.0.0"
+        if (a ~ /^(transparent|inform|audit)$/) rdata = "CNAME rpz-passthru."
+        print $1" "rdata from[$1]
+        print "*."$1" "rdata
+        if (a == "always_null") {
+          print $1" AAAA ::"
+          print "*."$1" AAAA ::"
+        }
+      }' "${tmpdir}/zone-sources" "${tmpdir}/zones.${i}"
+  done
+  safesearch_redirects | awk '
+    NR == 1 { print ""; print "; SafeSearch" }
+    { print $1" CNAME "$2"." }'
+}
+
+# Write an Unbound config file containing an rpz clause to stdout.
+write_rpz_config() {
+  echo "# Generated by $(readlink -f $0) at $(date --rfc-3339=seconds)"
+  echo "rpz:"
+  echo "  name: \"${RPZ_NAME}\""
+  echo "  zonefile: \"${RPZ_ZONEFILE}\""
+  # Log the queries that audited zones would have blocked.
+  if [ -n "$(sources | awk '/[ \t]action=audit([ \t]|$)/')" ]; then
+    echo "  rpz-log: yes"
+  fi
+}
+
+# Write the output in the requested format to the supplied path. An RPZ
+# zone file is also written alongside the config for the "rpz" format.
+render() {
+  case "$1" in
+    unbound)
+      write_unbound >"$2"
+      if [ -n "$chunksize" ]; then
+        split_unbound "$2" "${2}.d"
+        write_chunk_index >"${2}.index"
+      elif [ -n "$splitsources" ]; then
+        split_unbound_sources "$2" "${2}.d"
+        write_chunk_index >"${2}.index"
+      fi
+      ;;
+    rpz)
+      write_rpz_config >"$2"
+      write_rpz_zone >"${2}.rpz"
+      ;;
+    domains) write_domains >"$2" ;;
+    adblock) write_adblock >"$2" ;;
+    dnsdist) write_dnsdist >"$2" ;;
+    rbldnsd) write_rbldnsd >"$2" ;;
+    edl) write_edl >"$2" ;;
+    squid) write_squid >"$2" ;;
+    template) write_template >"$2" ;;
+    report) write_report "$3" >"$2" ;;
+    manifest) write_manifest >"$2" ;;
+    feed) write_feed >"$2" ;;
+  esac
+}
+
+# Render each output into "${tmpdir}/out.N".
+n=0
+echo "$targets" | while read -r f path; do
+  n=$((n + 1))
+  render "$f" "${tmpdir}/out.${n}" "$path"
 done
 
 if [ -n "$dryrun" ]; then
-  echo "Wrote config to ${out}"
+  n=0
+  echo "$targets" | while read -r f path; do
+    n=$((n + 1))
+    echo "Wrote ${f} output to ${tmpdir}/out.${n}"
+    if [ "$f" = rpz ]; then
+      echo "Wrote RPZ zone to ${tmpdir}/out.${n}.rpz"
+    elif [ "$f" = unbound ] && [ -n "$chunksize$splitsources" ]; then
+      echo "Wrote chunks to ${tmpdir}/out.${n}.d"
+    fi
+  done
+  exit 0
+fi
+
+# Print the name used for the output in format $1 with path $2 in PUBLISH_DIR.
+publish_name() {
+  case "$1" in
+    unbound|rpz) echo "${1}.conf" ;;
+    report)
+      case "$2" in
+        *.html|*.htm) echo report.html ;;
+        *) echo report.md ;;
+      esac
+      ;;
+    manifest) echo manifest.json ;;
+    feed) echo feed.xml ;;
+    *) echo "${1}.txt" ;;
+  esac
+}
+
+# Copy the file at $1 to "${PUBLISH_DIR}/${2}", along with compressed copies.
+# Each file is replaced atomically so clients never fetch a partial one.
+publish() {
+  cp "$1" "${PUBLISH_DIR}/.${2}.new"
+  gzip -9 -n -c "$1" >"${PUBLISH_DIR}/.${2}.gz.new"
+  chmod 644 "${PUBLISH_DIR}/.${2}.new" "${PUBLISH_DIR}/.${2}.gz.new"
+  mv "${PUBLISH_DIR}/.${2}.new" "${PUBLISH_DIR}/${2}"
+  mv "${PUBLISH_DIR}/.${2}.gz.new" "${PUBLISH_DIR}/${2}.gz"
+  if command -v zstd >/dev/null; then
+    zstd -q -19 -c "$1" >"${PUBLISH_DIR}/.${2}.zst.new"
+    chmod 644 "${PUBLISH_DIR}/.${2}.zst.new"
+    mv "${PUBLISH_DIR}/.${2}.zst.new" "${PUBLISH_DIR}/${2}.zst"
+  fi
+}
+
+# Publish the outputs, including the RPZ zone file for the "rpz" format, and
+# write the lists for other tools to the requested paths or to stdout. This is
+# only done after the Unbound config has been installed and Unbound is
+# healthy, so the other outputs never get ahead of a config that's rejected or
+# rolled back.
+write_outputs() {
+  if [ -n "$PUBLISH_DIR" ]; then
+    mkdir -p "$PUBLISH_DIR"
+    n=0
+    while read -r f path; do
+      n=$((n + 1))
+      publish "${tmpdir}/out.${n}" "$(publish_name "$f" "$path")"
+      if [ "$f" = rpz ]; then
+        publish "${tmpdir}/out.${n}.rpz" "${RPZ_NAME}"
+      fi
+    done <"${tmpdir}/targets"
+  fi
+  n=0
+  while read -r f path; do
+    n=$((n + 1))
+    case "$f" in
+      unbound|rpz) ;;
+      *)
+        if [ -n "$path" ]; then
+          mv "${tmpdir}/out.${n}" "$path"
+        else
+          cat "${tmpdir}/out.${n}"
+        fi
+        ;;
+    esac
+  done <"${tmpdir}/targets"
+}
+
+# Find the Unbound output, if any.
+n=0
+out=
+echo "$targets" >"${tmpdir}/targets"
+while read -r f path; do
+  n=$((n + 1))
+  case "$f" in
+    unbound|rpz)
+      out="${tmpdir}/out.${n}"
+      format=$f
+      [ -z "$path" ] || CONFIG="${UNBOUND_CHROOT%/}${path}"
+      ;;
+  esac
+done <"${tmpdir}/targets"
+if [ -z "$out" ]; then
+  write_outputs
+  save_state
+  exit 0
+fi
+
+# Return success if the file at $1 matches the one at $2 aside from the lines
+# deleted by the sed script in $3 (by default, the timestamp on the first line).
+same_content() {
+  [ -f "$2" ] || return 1
+  sed -e "${3:-1d}" "$2" >"${tmpdir}/installed"
+  sed -e "${3:-1d}" "$1" | cmp -s - "${tmpdir}/installed"
+}
+
+# Save the schedules and their zones to STATE_DIR for the schedule command and
+# apply them. If $1 is non-empty, Unbound was just reloaded and only has the
+# zones of the schedules that were active when the config was generated.
+save_schedules() {
+  mkdir -p "$STATE_DIR"
+  if [ -n "$1" ]; then
+    rm -f "${STATE_DIR}"/schedule.*.active
+  fi
+  while read -r n spec mode state; do
+    cp "${tmpdir}/scheduled.${n}" "${STATE_DIR}/schedule.${n}"
+    if [ -n "$1" ] && [ "$state" = on ]; then
+      cp "${tmpdir}/scheduled.${n}" "${STATE_DIR}/schedule.${n}.active"
+    fi
+  done <"${tmpdir}/schedules"
+  cut -d' ' -f1-3 "${tmpdir}/schedules" >"${STATE_DIR}/schedules"
+  apply_schedules
+}
+
+# Return success if the chunk files in the directory at $1 match the ones in
+# $CHUNK_DIR.
+same_chunks() {
+  [ -d "$CHUNK_DIR" ] || return 1
+  [ "$(ls "$1")" = "$(ls "$CHUNK_DIR")" ] || return 1
+  for f in "$1"/*; do
+    same_content "$f" "${CHUNK_DIR}/${f##*/}" || return 1
+  done
+}
+
+# Restart the Unbound service with systemd, OpenRC, or the init script,
+# printing the command's output if it fails. systemd reloads Unbound instead if
+# its unit supports that.
+restart_unbound() {
+  if [ -d /run/systemd/system ] && command -v systemctl >/dev/null; then
+    set -- systemctl reload-or-restart unbound
+  elif command -v rc-service >/dev/null; then
+    set -- rc-service unbound restart
+  elif command -v service >/dev/null; then
+    set -- service unbound restart
+  elif [ -x /etc/init.d/unbound ]; then
+    set -- /etc/init.d/unbound restart
+  else
+    echo "Don't know how to restart Unbound" >&2
+    return 1
+  fi
+  if ! err=$("$@" 2>&1); then
+    echo "\"$*\" failed: ${err}" >&2
+    return 1
+  fi
+}
+
+# Make Unbound reload its config. unbound-control's reload_keep_cache command
+# (only in newer Unbound versions) keeps the cache if the config change allows
+# it, and reload is used otherwise. If the control socket isn't usable, Unbound
+# is sent SIGHUP, and the service is only restarted if that fails too.
+reload_unbound() {
+  if unbound-control status >/dev/null 2>&1; then
+    if unbound-control reload_keep_cache >/dev/null 2>&1 || \
+        unbound-control reload >/dev/null 2>&1; then
+      return 0
+    fi
+  fi
+  if [ -f /run/unbound.pid ] && \
+      kill -HUP "$(cat /run/unbound.pid)" 2>/dev/null; then
+    return 0
+  fi
+  restart_unbound
+}
+
+# Return success if Unbound comes back within HEALTH_TIMEOUT seconds after being
+# reloaded. It's checked with unbound-control if $1 is non-empty (i.e. its
+# control socket was usable before the reload) and through its PID file
+# otherwise. If neither is available, it's assumed to be healthy.
+unbound_healthy() {
+  i=0
+  while :; do
+    if [ -n "$1" ]; then
+      unbound-control status >/dev/null 2>&1 && return 0
+    elif [ -f /run/unbound.pid ]; then
+      kill -0 "$(cat /run/unbound.pid)" 2>/dev/null && return 0
+    else
+      return 0
+    fi
+    [ "$i" -lt "$HEALTH_TIMEOUT" ] || return 1
+    sleep 1
+    i=$((i + 1))
+  done
+}
+
+# Print "ZONE ACTION SINKHOLE" for the first zone in the new config that's
+# blocked for all clients at all times, for the health check.
+health_zone() {
+  enforced_sources | while read -r i url opts; do
+    [ -z "$(source_opt "$opts" clients)" ] || continue
+    [ -z "$(source_opt "$opts" schedule)" ] || continue
+    awk -v action="$(source_opt "$opts" action "$ACTION")" \
+      -v sinkhole="$(source_opt "$opts" sinkhole "$SINKHOLE")" \
+      -v catactions="$CATEGORY_ACTIONS" "$ZONE_ACTION_AWK"'
+      FILENAME != ARGV[3] { skip[$1] = 1; next }
+      !($1 in skip) { print $1, zone_action(), sinkhole; exit }' \
+      "${tmpdir}/zone-tags" "${tmpdir}/zone-schedules" "${tmpdir}/zones.${i}"
+  done | head -n1
+}
+
+# Query HEALTH_SERVER for the A records of $1 and return success if the answer
+# matches what's expected for the action in $2 (or "allow" for a name that
+# should be resolved normally). For "redirect", $3 contains the sinkhole
+# addresses.
+check_answer() {
+  a=$2
+  # RPZ output answers with NXDOMAIN for most actions.
+  if [ "$format" = rpz ]; then
+    case "$a" in
+      refuse|static|always_refuse) a=always_nxdomain ;;
+    esac
+  fi
+  st=0
+  resp=$(dig +tries=1 +time=2 "@${HEALTH_SERVER}" "$1" A 2>/dev/null) || st=$?
+  status=$(echo "$resp" | sed -n -e 's/.*status: \([A-Z]*\),.*/\1/p')
+  addrs=$(echo "$resp" | awk '
+    /^;; ANSWER SECTION/ { answer = 1; next }
+    answer && /^$/ { exit }
+    answer && $4 == "A" { print $5 }' | sort | tr '\n' ' ')
+  case "$a" in
+    allow) [ "$status" = NOERROR ] ;;
+    refuse|always_refuse) [ "$status" = REFUSED ] ;;
+    static|always_nxdomain) [ "$status" = NXDOMAIN ] ;;
+    always_nodata) [ "$status" = NOERROR ] && [ -z "$addrs" ] ;;
+    always_null) [ "$addrs" = "0.0.0.0 " ] ;;
+    redirect)
+      [ "$addrs" = "$(echo "$3" | tr , '\n' | grep -v : | sort | tr '\n' ' ')" ]
+      ;;
+    deny|always_deny|inform_deny) [ "$st" -ne 0 ] ;;
+    *) return 0 ;;
+  esac
+}
+
+# Return success if Unbound answers queries for a blocked zone and for
+# HEALTH_ALLOWED as expected, printing the problem to stderr otherwise.
+check_queries() {
+  [ -n "$HEALTH_SERVER" ] || return 0
+  if ! command -v dig >/dev/null; then
+    echo "dig not found; skipping health check queries" >&2
+    return 0
+  fi
+  read -r zone action sinkhole <<EOF
+$(health_zone)
+EOF
+  if [ -n "$zone" ] && ! check_answer "$zone" "$action" "$sinkhole"; then
+    echo "${HEALTH_SERVER} didn't block ${zone} (${status:-no response})" >&2
+    return 1
+  fi
+  if [ -n "$HEALTH_ALLOWED" ] && ! check_answer "$HEALTH_ALLOWED" allow; then
+    echo "${HEALTH_SERVER} didn't resolve ${HEALTH_ALLOWED}" \
+      "(${status:-no response})" >&2
+    return 1
+  fi
+}
+
+# Write a copy of MAIN_CONFIG to stdout that includes the file at $1 instead of
+# CONFIG. Includes with wildcards matching CONFIG are expanded to the other
+# files that they match. Files included by other files aren't rewritten.
+# Included paths may be within UNBOUND_CHROOT.
+main_config_with() {
+  while IFS= read -r line; do
+    pattern=$(printf '%s\n' "$line" | \
+      sed -n -e 's/^\s*include[-a-z]*:\s*"\?\([^"[:space:]]*\).*/\1/p')
+    case "$pattern" in
+      "${UNBOUND_CHROOT%/}"/*) ;;
+      /*) pattern="${UNBOUND_CHROOT%/}${pattern}" ;;
+    esac
+    case "$CONFIG" in
+      $pattern) ;;
+      *) printf '%s\n' "$line"; continue ;;
+    esac
+    directive=$(printf '%s\n' "$line" | sed -e 's/^\s*//' -e 's/:.*//')
+    for f in $pattern; do
+      if [ "$f" != "$CONFIG" ] && [ -e "$f" ]; then
+        echo "${directive}: \"${f}\""
+      fi
+    done
+    echo "${directive}: \"${1}\""
+  done <"$MAIN_CONFIG"
+}
+
+# Restore the config files saved with ".bak" suffixes before they were replaced.
+rollback() {
+  if [ -f "${CONFIG}.bak" ]; then
+    mv "${CONFIG}.bak" "$CONFIG"
+  else
+    rm -f "$CONFIG"
+  fi
+  if [ "$format" = rpz ] && [ -f "${RPZ_ZONEFILE}.bak" ]; then
+    mv "${RPZ_ZONEFILE}.bak" "$RPZ_ZONEFILE"
+  fi
+  if [ "$format" = unbound ] && [ -n "$chunksize$splitsources" ] && \
+      [ -d "${CHUNK_DIR}.bak" ]; then
+    install_chunks "$(stage_chunks "${CHUNK_DIR}.bak")"
+  fi
+}
+
+# Write the changes to the local-zone directives in the new Unbound config at $1
+# to "${tmpdir}/zone-adds" as "ZONE TYPE" lines and "${tmpdir}/zone-removes" as
+# zone names, for apply_zone_changes. Returns 1 if the installed config is
+# missing or differs in other ways (e.g. local-data or tags), or if there are
+# more than INCREMENTAL_MAX_CHANGES changes.
+zone_changes() {
+  old=$CONFIG
+  if [ -n "$chunksize$splitsources" ]; then
+    old="${tmpdir}/installed-chunks"
+    cat "${CHUNK_DIR}"/*.conf >"$old" 2>/dev/null || return 1
+  fi
+  [ -f "$old" ] || return 1
+  for f in old new; do
+    [ "$f" = old ] && path=$old || path=$1
+    grep -v -e '^local-zone: ' -e '^#' -e '^server:$' -e '^$' "$path" \
+      >"${tmpdir}/other-lines.${f}" || true
+    sed -n -e 's/^local-zone: "\([^"]*\)" \([^ ]*\).*/\1 \2/p' "$path" | \
+      LC_ALL=C sort >"${tmpdir}/local-zones.${f}"
+  done
+  cmp -s "${tmpdir}/other-lines.old" "${tmpdir}/other-lines.new" || return 1
+  # Adding an existing zone just changes its type.
+  added_lines "${tmpdir}/local-zones.old" "${tmpdir}/local-zones.new" \
+    >"${tmpdir}/zone-adds"
+  added_lines "${tmpdir}/local-zones.new" "${tmpdir}/local-zones.old" | \
+    awk '
+      FILENAME == ARGV[1] { added[$1] = 1; next }
+      !($1 in added) { print $1 }' "${tmpdir}/zone-adds" - \
+    >"${tmpdir}/zone-removes"
+  changes=$(cat "${tmpdir}/zone-adds" "${tmpdir}/zone-removes" | wc -l)
+  [ "$changes" -le "$INCREMENTAL_MAX_CHANGES" ]
+}
+
+# Apply the changes found by zone_changes to the running Unbound using
+# unbound-control. Returns 1 if unbound-control fails.
+apply_zone_changes() {
+  if [ -s "${tmpdir}/zone-removes" ]; then
+    unbound-control local_zones_remove <"${tmpdir}/zone-removes" >/dev/null || \
+      return 1
+  fi
+  if [ -s "${tmpdir}/zone-adds" ]; then
+    unbound-control local_zones <"${tmpdir}/zone-adds" >/dev/null || return 1
+  fi
+}
+
+# Leave the installed files alone if they're already up to date, since
+# reloading Unbound needlessly flushes its cache. The RPZ zone file's serial
+# number is also ignored.
+if [ "$format" = rpz ]; then
+  if same_content "$out" "$CONFIG" && \
+      same_content "${out}.rpz" "$RPZ_ZONEFILE" '1d;3d'; then
+    write_outputs
+    save_state
+    exit 0
+  fi
+elif [ -n "$chunksize$splitsources" ]; then
+  if same_content "${out}.index" "$CONFIG" && same_chunks "${out}.d"; then
+    save_schedules
+    write_outputs
+    save_state
+    exit 0
+  fi
+elif same_content "$out" "$CONFIG"; then
+  save_schedules
+  write_outputs
+  save_state
   exit 0
 fi
 
 # Validate the config, install it, and restart the daemon.
-if ! err=$(unbound-checkconf "$out" 2>&1); then
+if ! err=$($CHECKCONF_CMD "$out" 2>&1); then
   echo "${err}" >&2
   exit 1
 fi
-mv "$out" "$CONFIG"
-kill -HUP $(cat /run/unbound.pid)
+
+# Stage the new files next to the installed ones. If MAIN_CONFIG exists, check
+# it with the staged files in place of the installed ones (RPZ and chunk configs
+# get copies referring to the staged zone file and chunks), and discard them
+# if it fails.
+chunks=
+if [ "$format" = rpz ]; then
+  cp "${out}.rpz" "${RPZ_ZONEFILE}.new"
+  set_perms "${RPZ_ZONEFILE}.new"
+fi
+if [ "$format" = unbound ] && [ -n "$chunksize$splitsources" ]; then
+  chunks=$(stage_chunks "${out}.d")
+  out="${out}.index"
+fi
+cp "$out" "${CONFIG}.new"
+set_perms "${CONFIG}.new"
+if [ -f "$MAIN_CONFIG" ]; then
+  check="${CONFIG}.new"
+  if [ "$format" = rpz ]; then
+    check="${CONFIG}.check"
+    awk -v f="${RPZ_ZONEFILE}.new" '
+      /^  zonefile: / { print "  zonefile: \"" f "\""; next }
+      { print }' "${CONFIG}.new" >"$check"
+  elif [ -n "$chunks" ]; then
+    check="${CONFIG}.check"
+    echo "include: \"${chunks}/blocklist-*.conf\"" >"$check"
+  fi
+  main_config_with "$check" >"${MAIN_CONFIG}.check"
+  st=0
+  err=$($CHECKCONF_CMD "${MAIN_CONFIG}.check" 2>&1) || st=$?
+  rm -f "${MAIN_CONFIG}.check" "${CONFIG}.check"
+  if [ "$st" -ne 0 ]; then
+    echo "${err}" >&2
+    rm -rf "${CONFIG}.new" "${RPZ_ZONEFILE}.new" "$chunks"
+    exit 1
+  fi
+fi
+
+# Keep the installed files so they can be restored if Unbound doesn't come back
+# after reloading.
+if [ -f "$CONFIG" ]; then
+  cp -p "$CONFIG" "${CONFIG}.bak"
+fi
+if [ "$format" = rpz ] && [ -f "$RPZ_ZONEFILE" ]; then
+  cp -p "$RPZ_ZONEFILE" "${RPZ_ZONEFILE}.bak"
+fi
+
+# Before replacing the installed files, check whether the running Unbound can
+# be updated without reloading it. If the rpz clause is already installed,
+# Unbound just needs to reread the zone file. Small changes to local zones can
+# be applied directly, but the new config is still installed for the next time
+# Unbound starts.
+reload=1
+zonereload=
+if [ "$format" = rpz ] && [ -f "$CONFIG" ] && \
+    [ "$(sed 1d "${CONFIG}.new")" = "$(sed 1d "$CONFIG")" ]; then
+  reload=
+  zonereload=1
+elif [ "$format" = unbound ] && [ "$INCREMENTAL_MAX_CHANGES" -gt 0 ] && \
+    zone_changes "${CONFIG}.new"; then
+  reload=
+fi
+
+if [ "$format" = rpz ]; then
+  mv "${RPZ_ZONEFILE}.new" "$RPZ_ZONEFILE"
+  restore_contexts "$RPZ_ZONEFILE"
+fi
+if [ -n "$chunks" ]; then
+  install_chunks "$chunks"
+fi
+mv "${CONFIG}.new" "$CONFIG"
+restore_contexts "$CONFIG"
+
+if [ -n "$zonereload" ]; then
+  if ! unbound-control auth_zone_reload "$RPZ_NAME" >/dev/null || \
+      ! unbound_healthy 1; then
+    echo "Unbound didn't reload the RPZ zone; restoring previous zone" >&2
+    rollback
+    unbound-control auth_zone_reload "$RPZ_NAME" >/dev/null ||
+      echo "Failed to reload previous zone" >&2
+    exit 1
+  fi
+  if ! check_queries; then
+    echo "Restoring previous zone" >&2
+    rollback
+    unbound-control auth_zone_reload "$RPZ_NAME" >/dev/null ||
+      echo "Failed to reload previous zone" >&2
+    exit 1
+  fi
+  write_outputs
+  save_state
+  exit 0
+fi
+if [ -z "$reload" ] && ! apply_zone_changes; then
+  reload=1
+fi
+if [ -n "$reload" ]; then
+  control=
+  if unbound-control status >/dev/null 2>&1; then
+    control=1
+  fi
+  # The script would exit right away if the reload failed outside of a
+  # condition, leaving the new config installed.
+  reloaded=1
+  eval "$RELOAD_CMD" || reloaded=
+  if [ -z "$reloaded" ] || ! unbound_healthy "$control"; then
+    echo "Unbound didn't come back after reloading;" \
+      "restoring previous config" >&2
+    rollback
+    eval "$RELOAD_CMD" || echo "Failed to reload previous config" >&2
+    exit 1
+  fi
+  if ! check_queries; then
+    echo "Restoring previous config" >&2
+    rollback
+    eval "$RELOAD_CMD" || echo "Failed to reload previous config" >&2
+    exit 1
+  fi
+fi
+[ "$format" = unbound ] && save_schedules 1
+write_outputs
+save_state